@@ -0,0 +1,134 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package singleflight
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/bgq98/utils/internal/metrics"
+)
+
+// MiddlewareBuilder 把并发的相同 GET 请求合并成一个,只有一个请求会执行后面的 handler,
+// 它的响应会被缓存在内存里面,复制给其它等待的请求
+// 在需要的路由上面使用,只适合幂等的,和调用者身份无关的读请求,
+// 和身份有关的话要用 Key 把用户 id 之类的加进去
+type MiddlewareBuilder struct {
+	group singleflight.Group
+	key   func(ctx *gin.Context) string
+
+	registerer prometheus.Registerer
+	// requestCounter 和 grpcx 的请求合并一样,合并比例 = shared / (leader + shared)
+	requestCounter *prometheus.CounterVec
+}
+
+// NewMiddlewareBuilder 默认按照请求路径和查询参数合并
+func NewMiddlewareBuilder() *MiddlewareBuilder {
+	return &MiddlewareBuilder{
+		key: func(ctx *gin.Context) string {
+			return ctx.Request.URL.RequestURI()
+		},
+	}
+}
+
+func (b *MiddlewareBuilder) Key(fn func(ctx *gin.Context) string) *MiddlewareBuilder {
+	b.key = fn
+	return b
+}
+
+type response struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// Registerer 不设置就注册到 prometheus.DefaultRegisterer
+func (b *MiddlewareBuilder) Registerer(r prometheus.Registerer) *MiddlewareBuilder {
+	b.registerer = r
+	return b
+}
+
+// initMetrics Build 的时候才注册,同一个指标注册过了就用已经注册的
+func (b *MiddlewareBuilder) initMetrics() {
+	if b.requestCounter != nil {
+		return
+	}
+	b.requestCounter = metrics.Register(b.registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ginx_singleflight_requests_total",
+		Help: "请求合并的请求数",
+	}, []string{"pattern", "result"}))
+}
+
+func (b *MiddlewareBuilder) Build() gin.HandlerFunc {
+	b.initMetrics()
+	return func(ctx *gin.Context) {
+		if ctx.Request.Method != http.MethodGet {
+			ctx.Next()
+			return
+		}
+		leader := false
+		val, _, _ := b.group.Do(b.key(ctx), func() (any, error) {
+			leader = true
+			w := &recordWriter{ResponseWriter: ctx.Writer}
+			ctx.Writer = w
+			ctx.Next()
+			ctx.Writer = w.ResponseWriter
+			return &response{
+				status: w.Status(),
+				header: w.Header().Clone(),
+				body:   w.body.Bytes(),
+			}, nil
+		})
+		pattern := ctx.FullPath()
+		if pattern == "" {
+			pattern = "unknown"
+		}
+		if leader {
+			b.requestCounter.WithLabelValues(pattern, "leader").Inc()
+			return
+		}
+		b.requestCounter.WithLabelValues(pattern, "shared").Inc()
+		resp := val.(*response)
+		header := ctx.Writer.Header()
+		for k, vals := range resp.header {
+			header[k] = append([]string(nil), vals...)
+		}
+		ctx.Writer.WriteHeader(resp.status)
+		_, _ = ctx.Writer.Write(resp.body)
+		ctx.Abort()
+	}
+}
+
+// recordWriter 写给客户端的同时记录一份
+type recordWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,66 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package singleflight
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddlewareBuilder_Build(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := gin.New()
+	var calls atomic.Int32
+	release := make(chan struct{})
+	server.GET("/users/:id", NewMiddlewareBuilder().Build(), func(ctx *gin.Context) {
+		calls.Add(1)
+		<-release
+		ctx.Header("X-Served-By", "leader")
+		ctx.String(http.StatusOK, "Tom")
+	})
+
+	const n = 10
+	recorders := make([]*httptest.ResponseRecorder, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/users/123", nil)
+			recorders[i] = httptest.NewRecorder()
+			server.ServeHTTP(recorders[i], req)
+		}(i)
+	}
+	// 等所有请求都进去
+	time.Sleep(time.Millisecond * 100)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls.Load())
+	for _, recorder := range recorders {
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "Tom", recorder.Body.String())
+		assert.Equal(t, "leader", recorder.Header().Get("X-Served-By"))
+	}
+}
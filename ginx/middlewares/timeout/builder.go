@@ -0,0 +1,78 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package timeout
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HeaderTimeout 上游(例如网关)告诉我们还剩多少毫秒
+const HeaderTimeout = "X-Timeout-Ms"
+
+// MiddlewareBuilder 给 HTTP 请求设置超时时间
+// 设置在 ctx.Request.Context() 上,调用 gRPC 的时候 grpc 会把剩余时间带到下游,
+// 直接把 *gin.Context 传给 grpcx 的客户端也可以,timeout 拦截器会从 Request 里面取出来
+type MiddlewareBuilder struct {
+	defaultTimeout time.Duration
+	header         string
+}
+
+// NewMiddlewareBuilder defaultTimeout 上游没有传剩余时间的时候用这个,0 代表不设置
+func NewMiddlewareBuilder(defaultTimeout time.Duration) *MiddlewareBuilder {
+	return &MiddlewareBuilder{
+		defaultTimeout: defaultTimeout,
+		header:         HeaderTimeout,
+	}
+}
+
+func (b *MiddlewareBuilder) Header(header string) *MiddlewareBuilder {
+	b.header = header
+	return b
+}
+
+func (b *MiddlewareBuilder) Build() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		timeout := b.defaultTimeout
+		if val := ctx.GetHeader(b.header); val != "" {
+			ms, err := strconv.ParseInt(val, 10, 64)
+			if err == nil {
+				if ms <= 0 {
+					// 上游已经放弃了,没必要再处理
+					ctx.AbortWithStatus(http.StatusGatewayTimeout)
+					return
+				}
+				remaining := time.Duration(ms) * time.Millisecond
+				if timeout <= 0 || remaining < timeout {
+					timeout = remaining
+				}
+			}
+		}
+		if timeout <= 0 {
+			ctx.Next()
+			return
+		}
+		reqCtx, cancel := context.WithTimeout(ctx.Request.Context(), timeout)
+		defer cancel()
+		ctx.Request = ctx.Request.WithContext(reqCtx)
+		ctx.Next()
+	}
+}
@@ -0,0 +1,114 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package timeout
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddlewareBuilder_Build(t *testing.T) {
+	testCases := []struct {
+		name           string
+		defaultTimeout time.Duration
+		header         string
+		wantCode       int
+		// wantTimeout 大概的剩余时间,0 代表没有超时时间
+		wantTimeout time.Duration
+	}{
+		{
+			name:           "默认超时时间",
+			defaultTimeout: time.Second,
+			wantCode:       http.StatusOK,
+			wantTimeout:    time.Second,
+		},
+		{
+			name:     "不设置超时时间",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:           "上游剩余时间更短",
+			defaultTimeout: time.Second,
+			header:         "500",
+			wantCode:       http.StatusOK,
+			wantTimeout:    time.Millisecond * 500,
+		},
+		{
+			name:           "不能超过默认超时时间",
+			defaultTimeout: time.Second,
+			header:         "5000",
+			wantCode:       http.StatusOK,
+			wantTimeout:    time.Second,
+		},
+		{
+			name:        "没有默认超时时间",
+			header:      "5000",
+			wantCode:    http.StatusOK,
+			wantTimeout: time.Second * 5,
+		},
+		{
+			name:           "格式不对",
+			defaultTimeout: time.Second,
+			header:         "abc",
+			wantCode:       http.StatusOK,
+			wantTimeout:    time.Second,
+		},
+		{
+			name:           "上游已经超时",
+			defaultTimeout: time.Second,
+			header:         "0",
+			wantCode:       http.StatusGatewayTimeout,
+		},
+		{
+			name:           "负数",
+			defaultTimeout: time.Second,
+			header:         "-10",
+			wantCode:       http.StatusGatewayTimeout,
+		},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := gin.New()
+			var called bool
+			server.GET("/users", NewMiddlewareBuilder(tc.defaultTimeout).Build(), func(ctx *gin.Context) {
+				called = true
+				deadline, ok := ctx.Request.Context().Deadline()
+				if tc.wantTimeout == 0 {
+					assert.False(t, ok)
+				} else {
+					assert.True(t, ok)
+					assert.InDelta(t, tc.wantTimeout, time.Until(deadline), float64(time.Millisecond*100))
+				}
+				ctx.Status(http.StatusOK)
+			})
+			req := httptest.NewRequest(http.MethodGet, "/users", nil)
+			if tc.header != "" {
+				req.Header.Set(HeaderTimeout, tc.header)
+			}
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, req)
+			assert.Equal(t, tc.wantCode, recorder.Code)
+			assert.Equal(t, tc.wantCode == http.StatusOK, called)
+		})
+	}
+}
@@ -0,0 +1,62 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package backoff
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Exponential 指数退避
+// 第 n 次重试(从 0 开始)等待 Initial * Multiplier^n,最多等待 Max
+// Jitter 是随机抖动的比例,例如 0.2 代表在 [0.8, 1.2] 倍之间浮动,避免大家同时重试
+type Exponential struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     float64
+}
+
+// NewExponential 默认从 initial 开始翻倍,抖动 20%
+func NewExponential(initial, max time.Duration) Exponential {
+	return Exponential{
+		Initial:    initial,
+		Max:        max,
+		Multiplier: 2,
+		Jitter:     0.2,
+	}
+}
+
+// Next 计算第 attempt 次重试前需要等待的时间
+func (e Exponential) Next(attempt int) time.Duration {
+	if e.Initial <= 0 {
+		return 0
+	}
+	multiplier := e.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	d := float64(e.Initial) * math.Pow(multiplier, float64(attempt))
+	if e.Max > 0 && d > float64(e.Max) {
+		d = float64(e.Max)
+	}
+	if e.Jitter > 0 {
+		d = d * (1 + e.Jitter*(rand.Float64()*2-1))
+	}
+	return time.Duration(d)
+}
@@ -0,0 +1,74 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package backoff
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExponential_Next(t *testing.T) {
+	testCases := []struct {
+		name    string
+		b       Exponential
+		attempt int
+		wantMin time.Duration
+		wantMax time.Duration
+	}{
+		{
+			name:    "first",
+			b:       Exponential{Initial: time.Second, Max: time.Minute, Multiplier: 2},
+			attempt: 0,
+			wantMin: time.Second,
+			wantMax: time.Second,
+		},
+		{
+			name:    "doubled",
+			b:       Exponential{Initial: time.Second, Max: time.Minute, Multiplier: 2},
+			attempt: 3,
+			wantMin: time.Second * 8,
+			wantMax: time.Second * 8,
+		},
+		{
+			name:    "capped",
+			b:       Exponential{Initial: time.Second, Max: time.Second * 5, Multiplier: 2},
+			attempt: 10,
+			wantMin: time.Second * 5,
+			wantMax: time.Second * 5,
+		},
+		{
+			name:    "jitter",
+			b:       NewExponential(time.Second, time.Minute),
+			attempt: 1,
+			wantMin: time.Millisecond * 1600,
+			wantMax: time.Millisecond * 2400,
+		},
+		{
+			name:    "zero",
+			b:       Exponential{},
+			attempt: 1,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := tc.b.Next(tc.attempt)
+			assert.True(t, d >= tc.wantMin && d <= tc.wantMax, "got %s", d)
+		})
+	}
+}
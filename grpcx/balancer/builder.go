@@ -0,0 +1,47 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package balancer
+
+import (
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+// NewBuilder 和 base.NewBalancerBuilder 差不多,
+// 区别在于每个 ClientConn 都会调用 newPickerBuilder 拿到自己的 PickerBuilder,
+// 这样 PickerBuilder 就可以保存跨 Picker 的状态(例如动态权重),而不会和别的 ClientConn 混在一起
+func NewBuilder(name string, newPickerBuilder func() base.PickerBuilder, config base.Config) balancer.Builder {
+	return &builder{
+		name:             name,
+		newPickerBuilder: newPickerBuilder,
+		config:           config,
+	}
+}
+
+type builder struct {
+	name             string
+	newPickerBuilder func() base.PickerBuilder
+	config           base.Config
+}
+
+func (b *builder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	return base.NewBalancerBuilder(b.name, b.newPickerBuilder(), b.config).Build(cc, opts)
+}
+
+func (b *builder) Name() string {
+	return b.name
+}
@@ -0,0 +1,153 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package chash
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+
+	balancerx "github.com/bgq98/utils/grpcx/balancer"
+)
+
+// Name 一致性哈希,同一个 key 总是落到同一个节点上,适合要利用本地缓存的场景
+const Name = "custom_chash"
+
+func init() {
+	balancer.Register(base.NewBalancerBuilder(Name, &PickerBuilder{}, base.Config{HealthCheck: false}))
+}
+
+type keyKey struct{}
+
+// WithKey 指定哈希的 key,例如用户 id
+// 没有指定 key 的请求随机挑选一个节点
+func WithKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, keyKey{}, key)
+}
+
+func keyFromContext(ctx context.Context) (string, bool) {
+	if ctx == nil {
+		return "", false
+	}
+	key, ok := ctx.Value(keyKey{}).(string)
+	return key, ok
+}
+
+type PickerBuilder struct {
+	// Replicas 每个节点的虚拟节点数量,默认 160,
+	// 虚拟节点越多,key 分布越均匀
+	Replicas int
+}
+
+// Build 虚拟节点是按照节点的地址来计算哈希的,
+// 所以节点上下线的时候,只有落在这个节点上的 key 会被重新分配
+func (p *PickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	replicas := p.Replicas
+	if replicas <= 0 {
+		replicas = 160
+	}
+	conns := make([]*conn, 0, len(info.ReadySCs))
+	ring := make([]virtualNode, 0, len(info.ReadySCs)*replicas)
+	for sc, sci := range info.ReadySCs {
+		cc := &conn{
+			cc:   sc,
+			node: balancerx.ParseMetadata(sci.Address.Metadata),
+		}
+		conns = append(conns, cc)
+		for i := 0; i < replicas; i++ {
+			ring = append(ring, virtualNode{
+				hash: hash(sci.Address.Addr + "#" + strconv.Itoa(i)),
+				cc:   cc,
+			})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	return &Picker{
+		conns: conns,
+		ring:  ring,
+	}
+}
+
+// Picker 构造好之后就是只读的,不需要加锁
+type Picker struct {
+	conns []*conn
+	ring  []virtualNode
+}
+
+func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	if len(p.conns) == 0 {
+		return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+	}
+	candidates, err := balancerx.Select(info.Ctx, p.conns, func(cc *conn) balancerx.Node {
+		return cc.node
+	})
+	if err != nil {
+		return balancer.PickResult{}, err
+	}
+	key, ok := keyFromContext(info.Ctx)
+	if !ok {
+		return balancer.PickResult{SubConn: candidates[rand.Intn(len(candidates))].cc}, nil
+	}
+
+	allowed := make(map[*conn]struct{}, len(candidates))
+	for _, cc := range candidates {
+		allowed[cc] = struct{}{}
+	}
+	h := hash(key)
+	// 顺时针找到第一个虚拟节点,被标签过滤掉的节点就继续往后找
+	idx := sort.Search(len(p.ring), func(i int) bool {
+		return p.ring[i].hash >= h
+	})
+	for i := 0; i < len(p.ring); i++ {
+		vn := p.ring[(idx+i)%len(p.ring)]
+		if _, ok := allowed[vn.cc]; ok {
+			return balancer.PickResult{SubConn: vn.cc.cc}, nil
+		}
+	}
+	return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+}
+
+type virtualNode struct {
+	hash uint64
+	cc   *conn
+}
+
+type conn struct {
+	cc   balancer.SubConn
+	node balancerx.Node
+}
+
+// hash fnv 对于只有末尾几位不同的字符串(例如 addr#1, addr#2)分布不够散,
+// 所以再用 splitmix64 的 finalizer 打散一下
+func hash(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,73 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package chash
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+type subConn struct {
+	balancer.SubConn
+	name string
+}
+
+func build(scs ...*subConn) balancer.Picker {
+	ready := make(map[balancer.SubConn]base.SubConnInfo, len(scs))
+	for _, sc := range scs {
+		ready[sc] = base.SubConnInfo{Address: resolver.Address{Addr: sc.name}}
+	}
+	return (&PickerBuilder{}).Build(base.PickerBuildInfo{ReadySCs: ready})
+}
+
+func pickAll(t *testing.T, p balancer.Picker, keys int) map[string]string {
+	res := make(map[string]string, keys)
+	for i := 0; i < keys; i++ {
+		key := "user-" + strconv.Itoa(i)
+		pr, err := p.Pick(balancer.PickInfo{Ctx: WithKey(context.Background(), key)})
+		require.NoError(t, err)
+		res[key] = pr.SubConn.(*subConn).name
+	}
+	return res
+}
+
+func TestPicker_Pick(t *testing.T) {
+	a, b, c := &subConn{name: "10.0.0.1:8080"}, &subConn{name: "10.0.0.2:8080"}, &subConn{name: "10.0.0.3:8080"}
+	before := pickAll(t, build(a, b, c), 1000)
+	// 同样的 key 落到同样的节点上
+	assert.Equal(t, before, pickAll(t, build(c, a, b), 1000))
+
+	// c 下线,只有原本在 c 上的 key 会变
+	after := pickAll(t, build(a, b), 1000)
+	moved := 0
+	for key, addr := range before {
+		if addr != c.name {
+			assert.Equal(t, addr, after[key])
+		} else {
+			moved++
+		}
+	}
+	// 虚拟节点足够多的时候每个节点分到的 key 差不多
+	assert.InDelta(t, 333, moved, 60)
+}
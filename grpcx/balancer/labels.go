@@ -0,0 +1,96 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package balancer
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type labelsKey struct{}
+
+// LabelSelector 调用方希望命中的节点标签
+// Fallback 为 true 的时候,没有节点满足条件就退回到所有节点
+type LabelSelector struct {
+	Labels   []string
+	Fallback bool
+}
+
+// WithLabels 优先选择有全部 labels 的节点,例如 canary, zone=sh, tenant=xxx
+// 没有满足条件的节点就退回到所有节点
+func WithLabels(ctx context.Context, labels ...string) context.Context {
+	return context.WithValue(ctx, labelsKey{}, LabelSelector{Labels: labels, Fallback: true})
+}
+
+// WithStrictLabels 只选择有全部 labels 的节点,没有就直接返回 Unavailable
+func WithStrictLabels(ctx context.Context, labels ...string) context.Context {
+	return context.WithValue(ctx, labelsKey{}, LabelSelector{Labels: labels})
+}
+
+func LabelsFromContext(ctx context.Context) (LabelSelector, bool) {
+	if ctx == nil {
+		return LabelSelector{}, false
+	}
+	sel, ok := ctx.Value(labelsKey{}).(LabelSelector)
+	return sel, ok && len(sel.Labels) > 0
+}
+
+// Select 按照 ctx 里面的 LabelSelector 过滤候选节点,再去掉权重为 0 的节点
+// 所有候选节点的权重都是 0 的时候全部保留,调用者按照相同的权重挑选
+func Select[T any](ctx context.Context, items []T, node func(T) Node) ([]T, error) {
+	res, err := selectLabels(ctx, items, node)
+	if err != nil {
+		return nil, err
+	}
+	return skipDrained(res, node), nil
+}
+
+func skipDrained[T any](items []T, node func(T) Node) []T {
+	res := make([]T, 0, len(items))
+	for _, item := range items {
+		if node(item).Weight > 0 {
+			res = append(res, item)
+		}
+	}
+	if len(res) == 0 {
+		return items
+	}
+	return res
+}
+
+func selectLabels[T any](ctx context.Context, items []T, node func(T) Node) ([]T, error) {
+	sel, ok := LabelsFromContext(ctx)
+	if !ok {
+		return items, nil
+	}
+	res := make([]T, 0, len(items))
+	for _, item := range items {
+		if node(item).Match(sel.Labels) {
+			res = append(res, item)
+		}
+	}
+	if len(res) > 0 {
+		return res, nil
+	}
+	if sel.Fallback {
+		return items, nil
+	}
+	return nil, status.Errorf(codes.Unavailable, "没有满足标签 %s 的节点", strings.Join(sel.Labels, ","))
+}
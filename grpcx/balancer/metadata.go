@@ -0,0 +1,131 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package balancer
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// DefaultWeight 节点没有注册权重的时候使用的权重
+const DefaultWeight = 10
+
+// Node 是 grpcx.Server 注册到 etcd 上的节点元数据
+// 经过 etcd 和 JSON 一来一回之后,数字都变成了 float64,切片都变成了 []any,
+// 所以不能直接断言,统一用 ParseMetadata 来解析
+// Weight 为 0 代表节点正在下线,不应该再分配流量,见 Select
+type Node struct {
+	Weight  int
+	Labels  []string
+	Version string
+	Zone    string
+}
+
+// ParseMetadata 解析 resolver.Address.Metadata,解析不了的字段保持零值
+// 没有注册权重或者权重解析不了的时候用 DefaultWeight,负数当作 0
+func ParseMetadata(md any) Node {
+	node := Node{Weight: DefaultWeight}
+	m, ok := md.(map[string]any)
+	if !ok {
+		return node
+	}
+	if weight, ok := toInt(m["weight"]); ok {
+		node.Weight = weight
+		if weight < 0 {
+			node.Weight = 0
+		}
+	}
+	node.Labels = toStrings(m["labels"])
+	node.Version, _ = m["version"].(string)
+	node.Zone, _ = m["zone"].(string)
+	return node
+}
+
+// HasLabel 节点是否有这个标签
+// zone=xxx 和 version=xxx 会和 Zone 和 Version 比较
+func (n Node) HasLabel(label string) bool {
+	if k, v, ok := strings.Cut(label, "="); ok {
+		switch k {
+		case "zone":
+			if n.Zone == v {
+				return true
+			}
+		case "version":
+			if n.Version == v {
+				return true
+			}
+		}
+	}
+	for _, l := range n.Labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// Match 节点是否有全部的标签
+func (n Node) Match(labels []string) bool {
+	for _, l := range labels {
+		if !n.HasLabel(l) {
+			return false
+		}
+	}
+	return true
+}
+
+func toInt(val any) (int, bool) {
+	switch v := val.(type) {
+	case float64:
+		return int(v), true
+	case int:
+		return v, true
+	case int64:
+		return int(v), true
+	case json.Number:
+		i, err := v.Int64()
+		return int(i), err == nil
+	case string:
+		i, err := strconv.Atoi(v)
+		return i, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func toStrings(val any) []string {
+	switch v := val.(type) {
+	case []string:
+		return v
+	case []any:
+		res := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				res = append(res, s)
+			}
+		}
+		return res
+	case string:
+		if v == "" {
+			return nil
+		}
+		return strings.Split(v, ",")
+	default:
+		return nil
+	}
+}
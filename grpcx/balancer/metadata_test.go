@@ -0,0 +1,138 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package balancer
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseMetadata(t *testing.T) {
+	testCases := []struct {
+		name string
+		md   any
+		want Node
+	}{
+		{
+			name: "nil",
+			want: Node{Weight: DefaultWeight},
+		},
+		{
+			name: "json",
+			md:   decode(t, `{"weight":20,"labels":["canary","tenant=a"],"version":"v2","zone":"sh"}`),
+			want: Node{Weight: 20, Labels: []string{"canary", "tenant=a"}, Version: "v2", Zone: "sh"},
+		},
+		{
+			name: "bad types",
+			md:   map[string]any{"weight": "abc", "labels": 12, "zone": 1},
+			want: Node{Weight: DefaultWeight},
+		},
+		{
+			name: "no weight",
+			md:   decode(t, `{"labels":["canary"]}`),
+			want: Node{Weight: DefaultWeight, Labels: []string{"canary"}},
+		},
+		{
+			name: "drained",
+			md:   decode(t, `{"weight":0}`),
+			want: Node{Weight: 0},
+		},
+		{
+			name: "negative",
+			md:   map[string]any{"weight": -1},
+			want: Node{Weight: 0},
+		},
+		{
+			name: "native types",
+			md:   map[string]any{"weight": 5, "labels": []string{"canary"}},
+			want: Node{Weight: 5, Labels: []string{"canary"}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, ParseMetadata(tc.md))
+		})
+	}
+}
+
+func TestSelect(t *testing.T) {
+	nodes := []Node{
+		{Weight: 10, Labels: []string{"canary"}, Zone: "sh"},
+		{Weight: 10, Zone: "bj"},
+		{Weight: 0, Zone: "bj"},
+	}
+	identity := func(n Node) Node { return n }
+	testCases := []struct {
+		name     string
+		ctx      context.Context
+		want     []Node
+		wantCode codes.Code
+	}{
+		{
+			name: "no labels",
+			ctx:  context.Background(),
+			want: nodes[:2],
+		},
+		{
+			name: "canary",
+			ctx:  WithLabels(context.Background(), "canary"),
+			want: nodes[:1],
+		},
+		{
+			name: "zone",
+			ctx:  WithLabels(context.Background(), "zone=bj"),
+			want: nodes[1:2],
+		},
+		{
+			name: "fallback",
+			ctx:  WithLabels(context.Background(), "tenant=a"),
+			want: nodes[:2],
+		},
+		{
+			name:     "strict",
+			ctx:      WithStrictLabels(context.Background(), "canary", "zone=bj"),
+			wantCode: codes.Unavailable,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := Select(tc.ctx, nodes, identity)
+			assert.Equal(t, tc.wantCode, status.Code(err))
+			assert.Equal(t, tc.want, res)
+		})
+	}
+}
+
+// TestSelect_AllDrained 全部节点都在下线的时候不能没有节点可用
+func TestSelect_AllDrained(t *testing.T) {
+	nodes := []Node{{Zone: "sh"}, {Zone: "bj"}}
+	res, err := Select(context.Background(), nodes, func(n Node) Node { return n })
+	require.NoError(t, err)
+	assert.Equal(t, nodes, res)
+}
+
+func decode(t *testing.T, data string) any {
+	var res any
+	require.NoError(t, json.Unmarshal([]byte(data), &res))
+	return res
+}
@@ -0,0 +1,154 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package p2c
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+
+	balancerx "github.com/bgq98/utils/grpcx/balancer"
+	"github.com/bgq98/utils/grpcx/errs"
+)
+
+// Name power of two choices,随机挑两个节点,选负载低的那个
+// 负载 = (正在处理的请求数 + 1) * 平均响应时间(EWMA)
+const Name = "custom_p2c"
+
+func init() {
+	balancer.Register(balancerx.NewBuilder(Name, func() base.PickerBuilder {
+		return &PickerBuilder{}
+	}, base.Config{HealthCheck: false}))
+}
+
+const (
+	// decay EWMA 的衰减系数,越大越看重历史
+	decay = 0.8
+	// penalty 服务端出错的时候按照这个响应时间来计算,让出错的节点尽快被避开
+	penalty = time.Second
+)
+
+// PickerBuilder 每个 ClientConn 一个,保存了节点的负载,重建 Picker 的时候不会丢
+type PickerBuilder struct {
+	lock  sync.Mutex
+	stats map[balancer.SubConn]*stats
+}
+
+// Build 每次都创建新的 conn,旧的 Picker 可能还在用旧的 conn,所以 conn 创建之后就不能再改,
+// 只有负载 stats 在新旧 conn 之间共用
+func (p *PickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	existing := p.stats
+	p.stats = make(map[balancer.SubConn]*stats, len(info.ReadySCs))
+	conns := make([]*conn, 0, len(info.ReadySCs))
+	for sc, sci := range info.ReadySCs {
+		st, ok := existing[sc]
+		if !ok {
+			st = &stats{}
+		}
+		p.stats[sc] = st
+		conns = append(conns, &conn{
+			cc:    sc,
+			node:  balancerx.ParseMetadata(sci.Address.Metadata),
+			stats: st,
+		})
+	}
+	return &Picker{
+		conns: conns,
+	}
+}
+
+// Picker 节点的负载用原子操作和节点自己的锁来维护,Picker 本身是只读的
+type Picker struct {
+	conns []*conn
+}
+
+func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	if len(p.conns) == 0 {
+		return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+	}
+	candidates, err := balancerx.Select(info.Ctx, p.conns, func(cc *conn) balancerx.Node {
+		return cc.node
+	})
+	if err != nil {
+		return balancer.PickResult{}, err
+	}
+	picked := candidates[0]
+	if len(candidates) > 1 {
+		i := rand.Intn(len(candidates))
+		j := rand.Intn(len(candidates) - 1)
+		if j >= i {
+			j++
+		}
+		picked = candidates[i]
+		if candidates[j].load() < picked.load() {
+			picked = candidates[j]
+		}
+	}
+	picked.inflight.Add(1)
+	start := time.Now()
+	return balancer.PickResult{
+		SubConn: picked.cc,
+		Done: func(info balancer.DoneInfo) {
+			picked.inflight.Add(-1)
+			rt := time.Since(start)
+			if errs.IsServerFault(info.Err) && rt < penalty {
+				rt = penalty
+			}
+			picked.observe(rt)
+		},
+	}, nil
+}
+
+type conn struct {
+	cc   balancer.SubConn
+	node balancerx.Node
+	*stats
+}
+
+// stats 节点的负载
+type stats struct {
+	inflight atomic.Int64
+
+	lock sync.Mutex
+	// ewma 平均响应时间,单位是微秒
+	ewma float64
+}
+
+func (c *stats) load() float64 {
+	c.lock.Lock()
+	ewma := c.ewma
+	c.lock.Unlock()
+	// +1 是为了让刚上线,还没有响应时间的节点也能区分出负载
+	return float64(c.inflight.Load()+1) * (ewma + 1)
+}
+
+func (c *stats) observe(rt time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	us := float64(rt.Microseconds())
+	if c.ewma == 0 {
+		c.ewma = us
+		return
+	}
+	c.ewma = c.ewma*decay + us*(1-decay)
+}
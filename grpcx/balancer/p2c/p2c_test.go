@@ -0,0 +1,92 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package p2c
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+type subConn struct {
+	balancer.SubConn
+	name string
+}
+
+func TestPicker_Pick(t *testing.T) {
+	fast, slow := &subConn{name: "fast"}, &subConn{name: "slow"}
+	pb := &PickerBuilder{}
+	info := base.PickerBuildInfo{ReadySCs: map[balancer.SubConn]base.SubConnInfo{
+		fast: {Address: resolver.Address{Addr: fast.name}},
+		slow: {Address: resolver.Address{Addr: slow.name}},
+	}}
+	pb.Build(info)
+	pb.stats[fast].observe(time.Millisecond)
+	pb.stats[slow].observe(time.Millisecond * 100)
+
+	// 重建之后负载还在,而且只有两个节点的时候一定选负载低的那个
+	p := pb.Build(info)
+	for i := 0; i < 10; i++ {
+		res, err := p.Pick(balancer.PickInfo{Ctx: context.Background()})
+		require.NoError(t, err)
+		assert.Equal(t, fast, res.SubConn)
+		res.Done(balancer.DoneInfo{})
+	}
+	assert.Equal(t, int64(0), pb.stats[fast].inflight.Load())
+}
+
+// TestPicker_concurrentBuild 重建 Picker 的同时旧的 Picker 还在 Pick,用 go test -race 检查
+func TestPicker_concurrentBuild(t *testing.T) {
+	scs := make([]*subConn, 3)
+	ready := make(map[balancer.SubConn]base.SubConnInfo, len(scs))
+	for i := range scs {
+		scs[i] = &subConn{name: fmt.Sprintf("sc-%d", i)}
+		ready[scs[i]] = base.SubConnInfo{Address: resolver.Address{Addr: scs[i].name}}
+	}
+	info := base.PickerBuildInfo{ReadySCs: ready}
+	pb := &PickerBuilder{}
+	p := pb.Build(info)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			pb.Build(info)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			res, err := p.Pick(balancer.PickInfo{Ctx: context.Background()})
+			require.NoError(t, err)
+			res.Done(balancer.DoneInfo{})
+		}
+	}()
+	wg.Wait()
+	for _, sc := range scs {
+		assert.Equal(t, int64(0), pb.stats[sc].inflight.Load())
+	}
+}
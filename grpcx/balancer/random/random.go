@@ -0,0 +1,91 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package random
+
+import (
+	"math/rand"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+
+	balancerx "github.com/bgq98/utils/grpcx/balancer"
+)
+
+// Name 加权随机
+const Name = "custom_random"
+
+func init() {
+	balancer.Register(base.NewBalancerBuilder(Name, &PickerBuilder{}, base.Config{HealthCheck: false}))
+}
+
+type PickerBuilder struct {
+}
+
+func (p *PickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	conns := make([]*conn, 0, len(info.ReadySCs))
+	for sc, sci := range info.ReadySCs {
+		node := balancerx.ParseMetadata(sci.Address.Metadata)
+		cc := &conn{
+			cc:     sc,
+			weight: node.Weight,
+			node:   node,
+		}
+		conns = append(conns, cc)
+	}
+	return &Picker{
+		conns: conns,
+	}
+}
+
+// Picker 构造好之后就是只读的,不需要加锁
+type Picker struct {
+	conns []*conn
+}
+
+func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	if len(p.conns) == 0 {
+		return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+	}
+	candidates, err := balancerx.Select(info.Ctx, p.conns, func(cc *conn) balancerx.Node {
+		return cc.node
+	})
+	if err != nil {
+		return balancer.PickResult{}, err
+	}
+	total := 0
+	for _, cc := range candidates {
+		total += cc.weight
+	}
+	if total == 0 {
+		// 只剩下权重为 0 的节点,说明都在下线,平均分配
+		return balancer.PickResult{SubConn: candidates[rand.Intn(len(candidates))].cc}, nil
+	}
+	r := rand.Intn(total)
+	for _, cc := range candidates {
+		r -= cc.weight
+		if r < 0 {
+			return balancer.PickResult{SubConn: cc.cc}, nil
+		}
+	}
+	return balancer.PickResult{SubConn: candidates[len(candidates)-1].cc}, nil
+}
+
+type conn struct {
+	weight int
+	cc     balancer.SubConn
+	node   balancerx.Node
+}
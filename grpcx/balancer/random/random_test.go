@@ -0,0 +1,104 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package random
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+
+	balancerx "github.com/bgq98/utils/grpcx/balancer"
+)
+
+type subConn struct {
+	balancer.SubConn
+	name string
+}
+
+func buildInfo(scs map[*subConn]map[string]any) base.PickerBuildInfo {
+	ready := make(map[balancer.SubConn]base.SubConnInfo, len(scs))
+	for sc, md := range scs {
+		ready[sc] = base.SubConnInfo{
+			Address: resolver.Address{Addr: sc.name, Metadata: md},
+		}
+	}
+	return base.PickerBuildInfo{ReadySCs: ready}
+}
+
+// TestPicker_Pick 随机的结果不固定,次数足够多的时候比例接近权重
+func TestPicker_Pick(t *testing.T) {
+	a, b, c := &subConn{name: "a"}, &subConn{name: "b"}, &subConn{name: "c"}
+	p := (&PickerBuilder{}).Build(buildInfo(map[*subConn]map[string]any{
+		a: {"weight": float64(30)},
+		b: {"weight": float64(10)},
+		// 正在下线
+		c: {"weight": float64(0)},
+	}))
+	const n = 40000
+	cnt := map[string]int{}
+	for i := 0; i < n; i++ {
+		res, err := p.Pick(balancer.PickInfo{Ctx: context.Background()})
+		require.NoError(t, err)
+		cnt[res.SubConn.(*subConn).name]++
+	}
+	assert.InDelta(t, 0.75, float64(cnt["a"])/n, 0.02)
+	assert.InDelta(t, 0.25, float64(cnt["b"])/n, 0.02)
+	assert.Equal(t, 0, cnt["c"])
+}
+
+func TestPicker_Labels(t *testing.T) {
+	a, b := &subConn{name: "a"}, &subConn{name: "b"}
+	p := (&PickerBuilder{}).Build(buildInfo(map[*subConn]map[string]any{
+		a: {"weight": float64(30), "zone": "sh"},
+		b: {"weight": float64(10), "labels": []any{"canary"}, "zone": "bj"},
+	}))
+	for i := 0; i < 20; i++ {
+		res, err := p.Pick(balancer.PickInfo{Ctx: balancerx.WithLabels(context.Background(), "canary")})
+		require.NoError(t, err)
+		assert.Equal(t, b, res.SubConn)
+
+		res, err = p.Pick(balancer.PickInfo{Ctx: balancerx.WithLabels(context.Background(), "zone=sh")})
+		require.NoError(t, err)
+		assert.Equal(t, a, res.SubConn)
+	}
+
+	_, err := p.Pick(balancer.PickInfo{Ctx: balancerx.WithStrictLabels(context.Background(), "tenant=a")})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+// TestPicker_AllDrained 全部节点都在下线的时候平均分配
+func TestPicker_AllDrained(t *testing.T) {
+	a, b := &subConn{name: "a"}, &subConn{name: "b"}
+	p := (&PickerBuilder{}).Build(buildInfo(map[*subConn]map[string]any{
+		a: {"weight": float64(0)},
+		b: {"weight": float64(0)},
+	}))
+	cnt := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		res, err := p.Pick(balancer.PickInfo{Ctx: context.Background()})
+		require.NoError(t, err)
+		cnt[res.SubConn.(*subConn).name]++
+	}
+	assert.Len(t, cnt, 2)
+}
@@ -18,53 +18,115 @@ package wrr
 
 import (
 	"sync"
+	"time"
 
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
+
+	balancerx "github.com/bgq98/utils/grpcx/balancer"
+	"github.com/bgq98/utils/grpcx/errs"
 )
 
-const name = "custom_wrr"
+const (
+	// Name 静态权重
+	Name = "custom_wrr"
+	// AdaptiveName 根据调用结果动态调整权重,参数见 DefaultAdaptiveConfig
+	AdaptiveName = "custom_wrr_adaptive"
+)
 
 func init() {
-	balancer.Register(base.NewBalancerBuilder(name, &PickerBuilder{}, base.Config{HealthCheck: false}))
+	Register(Name, nil)
+	Register(AdaptiveName, DefaultAdaptiveConfig())
+}
+
+// Register 注册一个加权轮询的负载均衡算法, cfg 为 nil 就是静态权重
+func Register(name string, cfg *AdaptiveConfig) {
+	balancer.Register(balancerx.NewBuilder(name, func() base.PickerBuilder {
+		return &PickerBuilder{
+			adaptive: cfg,
+		}
+	}, base.Config{HealthCheck: false}))
+}
+
+// AdaptiveConfig 动态权重的参数
+// 出错或者响应慢就按照系数降低有效权重,成功就每次恢复 RecoverStep,
+// 有效权重始终在 [MinWeight, MaxWeight] 之间
+type AdaptiveConfig struct {
+	// MinWeight 有效权重的下限,至少是 1,不然节点永远选不到,也就永远恢复不了
+	MinWeight int
+	// MaxWeight 有效权重的上限,0 代表不超过节点注册的权重
+	MaxWeight int
+	// ServerErrorFactor 服务端出错(Internal, Unavailable 等)时有效权重乘以这个系数
+	ServerErrorFactor float64
+	// OverloadFactor 服务端过载(DeadlineExceeded, ResourceExhausted)时有效权重乘以这个系数
+	OverloadFactor float64
+	// SlowThreshold 调用成功但是耗时超过这个值,也要降低有效权重,0 代表不考虑耗时
+	SlowThreshold time.Duration
+	SlowFactor    float64
+	// RecoverStep 每次成功恢复多少权重
+	RecoverStep int
+}
+
+func DefaultAdaptiveConfig() *AdaptiveConfig {
+	return &AdaptiveConfig{
+		MinWeight:         1,
+		ServerErrorFactor: 0.5,
+		OverloadFactor:    0.7,
+		SlowThreshold:     time.Second,
+		SlowFactor:        0.9,
+		RecoverStep:       1,
+	}
 }
 
+// PickerBuilder 每个 ClientConn 一个,
+// 保存了节点的状态,节点只要一直是 ready 的,重建 Picker 的时候状态就不会丢
 type PickerBuilder struct {
+	adaptive *AdaptiveConfig
+	// lock 所有的 Picker 共用,保护 conns 里面的权重
+	lock  sync.Mutex
+	conns map[balancer.SubConn]*conn
 }
 
 func (p *PickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	existing := p.conns
+	p.conns = make(map[balancer.SubConn]*conn, len(info.ReadySCs))
 	conns := make([]*conn, 0, len(info.ReadySCs))
 	// sc  => SubConn
 	// sci => SubConnInfo
 	for sc, sci := range info.ReadySCs {
-		cc := &conn{
-			cc: sc,
-		}
-		md, ok := sci.Address.Metadata.(map[string]interface{})
-		if ok {
-			weightVal := md["weight"]
-			weight, _ := weightVal.(float64)
-			cc.weight = int(weight)
-			cc.labels = md["labels"].([]string)
+		node := balancerx.ParseMetadata(sci.Address.Metadata)
+		weight := node.Weight
+		cc, ok := existing[sc]
+		if !ok || cc.weight != weight {
+			// 新节点,或者节点的权重被修改了,重新开始
+			cc = &conn{
+				cc:              sc,
+				weight:          weight,
+				effectiveWeight: weight,
+				currentWeight:   weight,
+			}
 		}
-
-		if cc.weight == 0 {
-			cc.weight = 10
-		}
-		cc.currentWeight = cc.weight
+		cc.node = node
+		p.conns[sc] = cc
 		conns = append(conns, cc)
 	}
 	return &Picker{
-		conns: conns,
+		conns:    conns,
+		lock:     &p.lock,
+		adaptive: p.adaptive,
 	}
 }
 
 type Picker struct {
-	conns []*conn
-	lock  sync.Mutex
+	conns    []*conn
+	lock     *sync.Mutex
+	adaptive *AdaptiveConfig
 }
 
 // Pick 在这里实现基于权重的负载均衡算法
+// 调用方可以通过 balancerx.WithLabels 来指定标签,只在满足标签的节点里面挑选
 func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
@@ -72,32 +134,99 @@ func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
 		// 没有候选节点
 		return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
 	}
+	candidates, err := balancerx.Select(info.Ctx, p.conns, func(cc *conn) balancerx.Node {
+		return cc.node
+	})
+	if err != nil {
+		return balancer.PickResult{}, err
+	}
+
+	// 只剩下权重为 0 的节点,说明都在下线,平均分配
+	equal := true
+	for _, cc := range candidates {
+		if cc.effectiveWeight > 0 {
+			equal = false
+			break
+		}
+	}
 
 	var total int
 	var maxCC *conn
 
 	// 计算当前权重
-	// label := info.Ctx.Value("label")
-	for _, cc := range p.conns {
-		// 如果要是 cc 里面的所有标签都不包含这个 label ，就跳过
-		total += cc.weight
-		cc.currentWeight = cc.currentWeight + cc.weight
+	for _, cc := range candidates {
+		w := cc.effectiveWeight
+		if equal {
+			w = 1
+		}
+		total += w
+		cc.currentWeight = cc.currentWeight + w
 		if maxCC == nil || cc.currentWeight > maxCC.currentWeight {
 			maxCC = cc
 		}
 	}
 	maxCC.currentWeight = maxCC.currentWeight - total
-	return balancer.PickResult{
+	res := balancer.PickResult{
 		SubConn: maxCC.cc,
-		Done: func(info balancer.DoneInfo) {
-			// 很多动态算法,根据调用结果来调整权重,就在这里
-		},
-	}, nil
+	}
+	if p.adaptive != nil {
+		start := time.Now()
+		res.Done = func(info balancer.DoneInfo) {
+			// 根据调用结果来调整权重
+			p.lock.Lock()
+			defer p.lock.Unlock()
+			maxCC.adjust(p.adaptive, info.Err, time.Since(start))
+		}
+	}
+	return res, nil
 }
 
 type conn struct {
-	weight        int
-	currentWeight int
-	cc            balancer.SubConn
-	labels        []string
+	// weight 节点注册的权重
+	weight int
+	// effectiveWeight 根据调用结果调整之后的权重,不开启动态权重的时候就等于 weight
+	effectiveWeight int
+	currentWeight   int
+	cc              balancer.SubConn
+	node            balancerx.Node
+}
+
+func (c *conn) adjust(cfg *AdaptiveConfig, err error, duration time.Duration) {
+	if c.weight == 0 {
+		// 正在下线的节点不参与动态调整,一直是 0
+		return
+	}
+	w := c.effectiveWeight
+	switch errs.Classify(err) {
+	case errs.ClassServer:
+		w = int(float64(w) * cfg.ServerErrorFactor)
+	case errs.ClassOverload:
+		w = int(float64(w) * cfg.OverloadFactor)
+	default:
+		// 调用方自己的问题不是节点的问题,也算成功
+		if cfg.SlowThreshold > 0 && duration > cfg.SlowThreshold {
+			w = int(float64(w) * cfg.SlowFactor)
+		} else {
+			w += cfg.RecoverStep
+		}
+	}
+	c.effectiveWeight = c.bound(cfg, w)
+}
+
+func (c *conn) bound(cfg *AdaptiveConfig, w int) int {
+	minWeight := cfg.MinWeight
+	if minWeight < 1 {
+		minWeight = 1
+	}
+	maxWeight := cfg.MaxWeight
+	if maxWeight <= 0 {
+		maxWeight = c.weight
+	}
+	if w < minWeight {
+		return minWeight
+	}
+	if w > maxWeight {
+		return maxWeight
+	}
+	return w
 }
@@ -0,0 +1,138 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package wrr
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+
+	balancerx "github.com/bgq98/utils/grpcx/balancer"
+)
+
+type subConn struct {
+	balancer.SubConn
+	name string
+}
+
+func buildInfo(scs map[*subConn]map[string]any) base.PickerBuildInfo {
+	ready := make(map[balancer.SubConn]base.SubConnInfo, len(scs))
+	for sc, md := range scs {
+		ready[sc] = base.SubConnInfo{
+			Address: resolver.Address{Addr: sc.name, Metadata: md},
+		}
+	}
+	return base.PickerBuildInfo{ReadySCs: ready}
+}
+
+func TestPicker_Pick(t *testing.T) {
+	a, b := &subConn{name: "a"}, &subConn{name: "b"}
+	pb := &PickerBuilder{}
+	p := pb.Build(buildInfo(map[*subConn]map[string]any{
+		a: {"weight": float64(30)},
+		b: {"weight": float64(10), "labels": []any{"canary"}},
+	}))
+	cnt := map[string]int{}
+	for i := 0; i < 40; i++ {
+		res, err := p.Pick(balancer.PickInfo{Ctx: context.Background()})
+		require.NoError(t, err)
+		cnt[res.SubConn.(*subConn).name]++
+	}
+	assert.Equal(t, map[string]int{"a": 30, "b": 10}, cnt)
+
+	for i := 0; i < 5; i++ {
+		res, err := p.Pick(balancer.PickInfo{Ctx: balancerx.WithLabels(context.Background(), "canary")})
+		require.NoError(t, err)
+		assert.Equal(t, b, res.SubConn)
+	}
+}
+
+func TestPicker_Adaptive(t *testing.T) {
+	a, b := &subConn{name: "a"}, &subConn{name: "b"}
+	scs := map[*subConn]map[string]any{
+		a: {"weight": float64(10)},
+		b: {"weight": float64(10)},
+	}
+	pb := &PickerBuilder{adaptive: DefaultAdaptiveConfig()}
+	p := pb.Build(buildInfo(scs))
+	// a 一直出错,权重一路降到下限
+	for i := 0; i < 20; i++ {
+		res, err := p.Pick(balancer.PickInfo{Ctx: context.Background()})
+		require.NoError(t, err)
+		if res.SubConn == a {
+			res.Done(balancer.DoneInfo{Err: status.Error(codes.Unavailable, "down")})
+		} else {
+			res.Done(balancer.DoneInfo{})
+		}
+	}
+	assert.Equal(t, 1, pb.conns[a].effectiveWeight)
+	assert.Equal(t, 10, pb.conns[b].effectiveWeight)
+
+	// 重建 Picker 之后状态还在
+	pb.Build(buildInfo(scs))
+	assert.Equal(t, 1, pb.conns[a].effectiveWeight)
+
+	// 参数错误不算节点的问题,慢慢恢复
+	for i := 0; i < 3; i++ {
+		pb.conns[a].adjust(pb.adaptive, status.Error(codes.InvalidArgument, "bad"), time.Millisecond)
+	}
+	assert.Equal(t, 4, pb.conns[a].effectiveWeight)
+
+	// 节点下线之后状态就清掉了
+	pb.Build(buildInfo(map[*subConn]map[string]any{b: scs[b]}))
+	assert.NotContains(t, pb.conns, balancer.SubConn(a))
+}
+
+func TestPicker_Drained(t *testing.T) {
+	a, b := &subConn{name: "a"}, &subConn{name: "b"}
+	pb := &PickerBuilder{adaptive: DefaultAdaptiveConfig()}
+	p := pb.Build(buildInfo(map[*subConn]map[string]any{
+		a: {"weight": float64(0)},
+		b: {},
+	}))
+	// 权重为 0 的节点在下线,不分配流量,没有注册权重的节点用默认权重
+	for i := 0; i < 10; i++ {
+		res, err := p.Pick(balancer.PickInfo{Ctx: context.Background()})
+		require.NoError(t, err)
+		assert.Equal(t, b, res.SubConn)
+		res.Done(balancer.DoneInfo{})
+	}
+	assert.Equal(t, balancerx.DefaultWeight, pb.conns[b].effectiveWeight)
+
+	// 全部都在下线的时候平均分配
+	p = pb.Build(buildInfo(map[*subConn]map[string]any{
+		a: {"weight": float64(0)},
+		b: {"weight": float64(0)},
+	}))
+	cnt := map[string]int{}
+	for i := 0; i < 10; i++ {
+		res, err := p.Pick(balancer.PickInfo{Ctx: context.Background()})
+		require.NoError(t, err)
+		cnt[res.SubConn.(*subConn).name]++
+		res.Done(balancer.DoneInfo{})
+	}
+	assert.Equal(t, map[string]int{"a": 5, "b": 5}, cnt)
+	assert.Equal(t, 0, pb.conns[a].effectiveWeight)
+}
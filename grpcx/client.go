@@ -0,0 +1,206 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package grpcx
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/naming/resolver"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	grpcresolver "google.golang.org/grpc/resolver"
+
+	"github.com/bgq98/utils/grpcx/balancer/wrr"
+)
+
+// ClientBuilder 通过 etcd 按照服务名来连接 Server 注册的服务
+// 拦截器按照 trace => logging => metrics => ratelimit => timeout => retry 的顺序执行,
+// trace 在最外层,这样后面的日志和监控都能拿到 trace 的上下文,
+// timeout 在 retry 外面,所有重试加起来不会超过超时时间,
+// retry 在最里层,每次重试都会重新经过负载均衡
+// 流式接口的拦截器按照 trace => logging => metrics => ratelimit 的顺序执行,
+// 流式接口没有超时和重试,调用方自己控制 ctx
+type ClientBuilder struct {
+	etcdClient *clientv3.Client
+	name       string
+	balancer   string
+	creds      credentials.TransportCredentials
+	keepalive  *keepalive.ClientParameters
+	resolver   grpcresolver.Builder
+
+	trace     grpc.UnaryClientInterceptor
+	logging   grpc.UnaryClientInterceptor
+	metrics   grpc.UnaryClientInterceptor
+	ratelimit grpc.UnaryClientInterceptor
+	timeout   grpc.UnaryClientInterceptor
+	retry     grpc.UnaryClientInterceptor
+
+	streamTrace     grpc.StreamClientInterceptor
+	streamLogging   grpc.StreamClientInterceptor
+	streamMetrics   grpc.StreamClientInterceptor
+	streamRateLimit grpc.StreamClientInterceptor
+
+	opts []grpc.DialOption
+}
+
+// NewClientBuilder name 和 Server.Name 保持一致
+func NewClientBuilder(etcdClient *clientv3.Client, name string) *ClientBuilder {
+	return &ClientBuilder{
+		etcdClient: etcdClient,
+		name:       name,
+		balancer:   wrr.Name,
+		creds:      insecure.NewCredentials(),
+	}
+}
+
+// Balancer 负载均衡算法,需要提前注册,默认 custom_wrr,
+// 想要根据调用结果动态调整权重可以用 custom_wrr_adaptive
+func (b *ClientBuilder) Balancer(name string) *ClientBuilder {
+	b.balancer = name
+	return b
+}
+
+// Resolver 不用 etcd 做服务发现的时候指定,例如 DNS,或者测试的时候用 manual.Resolver
+// 设置了之后 etcdClient 就用不上了
+func (b *ClientBuilder) Resolver(rb grpcresolver.Builder) *ClientBuilder {
+	b.resolver = rb
+	return b
+}
+
+// TLS 不设置就是不加密传输
+func (b *ClientBuilder) TLS(cfg *tls.Config) *ClientBuilder {
+	b.creds = credentials.NewTLS(cfg)
+	return b
+}
+
+func (b *ClientBuilder) KeepAlive(params keepalive.ClientParameters) *ClientBuilder {
+	b.keepalive = &params
+	return b
+}
+
+func (b *ClientBuilder) Trace(interceptor grpc.UnaryClientInterceptor) *ClientBuilder {
+	b.trace = interceptor
+	return b
+}
+
+func (b *ClientBuilder) Logging(interceptor grpc.UnaryClientInterceptor) *ClientBuilder {
+	b.logging = interceptor
+	return b
+}
+
+func (b *ClientBuilder) Metrics(interceptor grpc.UnaryClientInterceptor) *ClientBuilder {
+	b.metrics = interceptor
+	return b
+}
+
+func (b *ClientBuilder) RateLimit(interceptor grpc.UnaryClientInterceptor) *ClientBuilder {
+	b.ratelimit = interceptor
+	return b
+}
+
+func (b *ClientBuilder) Timeout(interceptor grpc.UnaryClientInterceptor) *ClientBuilder {
+	b.timeout = interceptor
+	return b
+}
+
+func (b *ClientBuilder) Retry(interceptor grpc.UnaryClientInterceptor) *ClientBuilder {
+	b.retry = interceptor
+	return b
+}
+
+func (b *ClientBuilder) StreamTrace(interceptor grpc.StreamClientInterceptor) *ClientBuilder {
+	b.streamTrace = interceptor
+	return b
+}
+
+func (b *ClientBuilder) StreamLogging(interceptor grpc.StreamClientInterceptor) *ClientBuilder {
+	b.streamLogging = interceptor
+	return b
+}
+
+func (b *ClientBuilder) StreamMetrics(interceptor grpc.StreamClientInterceptor) *ClientBuilder {
+	b.streamMetrics = interceptor
+	return b
+}
+
+func (b *ClientBuilder) StreamRateLimit(interceptor grpc.StreamClientInterceptor) *ClientBuilder {
+	b.streamRateLimit = interceptor
+	return b
+}
+
+// DialOptions 额外的 grpc.DialOption,会放在最后
+func (b *ClientBuilder) DialOptions(opts ...grpc.DialOption) *ClientBuilder {
+	b.opts = append(b.opts, opts...)
+	return b
+}
+
+func (b *ClientBuilder) Build() (*grpc.ClientConn, error) {
+	rb := b.resolver
+	if rb == nil {
+		var err error
+		rb, err = resolver.NewBuilder(b.etcdClient)
+		if err != nil {
+			return nil, err
+		}
+	}
+	opts := []grpc.DialOption{
+		grpc.WithResolvers(rb),
+		grpc.WithTransportCredentials(b.creds),
+		grpc.WithDefaultServiceConfig(fmt.Sprintf(`{"loadBalancingConfig":[{%q:{}}]}`, b.balancer)),
+	}
+	if b.keepalive != nil {
+		opts = append(opts, grpc.WithKeepaliveParams(*b.keepalive))
+	}
+	unary := b.unaryInterceptors()
+	if len(unary) > 0 {
+		opts = append(opts, grpc.WithChainUnaryInterceptor(unary...))
+	}
+	stream := b.streamInterceptors()
+	if len(stream) > 0 {
+		opts = append(opts, grpc.WithChainStreamInterceptor(stream...))
+	}
+	opts = append(opts, b.opts...)
+	return grpc.Dial(rb.Scheme()+":///service/"+b.name, opts...)
+}
+
+func (b *ClientBuilder) unaryInterceptors() []grpc.UnaryClientInterceptor {
+	res := make([]grpc.UnaryClientInterceptor, 0, 6)
+	for _, interceptor := range []grpc.UnaryClientInterceptor{
+		b.trace, b.logging, b.metrics, b.ratelimit, b.timeout, b.retry,
+	} {
+		if interceptor != nil {
+			res = append(res, interceptor)
+		}
+	}
+	return res
+}
+
+func (b *ClientBuilder) streamInterceptors() []grpc.StreamClientInterceptor {
+	res := make([]grpc.StreamClientInterceptor, 0, 4)
+	for _, interceptor := range []grpc.StreamClientInterceptor{
+		b.streamTrace, b.streamLogging, b.streamMetrics, b.streamRateLimit,
+	} {
+		if interceptor != nil {
+			res = append(res, interceptor)
+		}
+	}
+	return res
+}
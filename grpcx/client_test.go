@@ -0,0 +1,203 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package grpcx
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	"google.golang.org/grpc/status"
+
+	balancerx "github.com/bgq98/utils/grpcx/balancer"
+)
+
+func TestClientBuilder_unaryInterceptors(t *testing.T) {
+	var order []string
+	record := func(name string) grpc.UnaryClientInterceptor {
+		return func(ctx context.Context, method string, req, reply any,
+			cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			order = append(order, name)
+			return nil
+		}
+	}
+	testCases := []struct {
+		name    string
+		builder func() *ClientBuilder
+		want    []string
+	}{
+		{
+			name: "all",
+			builder: func() *ClientBuilder {
+				// 设置的顺序不影响执行的顺序
+				return NewClientBuilder(nil, "user").
+					Retry(record("retry")).
+					Timeout(record("timeout")).
+					RateLimit(record("ratelimit")).
+					Metrics(record("metrics")).
+					Logging(record("logging")).
+					Trace(record("trace"))
+			},
+			want: []string{"trace", "logging", "metrics", "ratelimit", "timeout", "retry"},
+		},
+		{
+			name: "skip nil",
+			builder: func() *ClientBuilder {
+				return NewClientBuilder(nil, "user").
+					Trace(record("trace")).
+					Timeout(record("timeout"))
+			},
+			want: []string{"trace", "timeout"},
+		},
+		{
+			name: "none",
+			builder: func() *ClientBuilder {
+				return NewClientBuilder(nil, "user")
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			order = nil
+			for _, interceptor := range tc.builder().unaryInterceptors() {
+				_ = interceptor(context.Background(), "", nil, nil, nil, nil)
+			}
+			assert.Equal(t, tc.want, order)
+		})
+	}
+}
+
+func TestClientBuilder_streamInterceptors(t *testing.T) {
+	var order []string
+	record := func(name string) grpc.StreamClientInterceptor {
+		return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+			method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			order = append(order, name)
+			return nil, nil
+		}
+	}
+	testCases := []struct {
+		name    string
+		builder func() *ClientBuilder
+		want    []string
+	}{
+		{
+			name: "all",
+			builder: func() *ClientBuilder {
+				return NewClientBuilder(nil, "user").
+					StreamRateLimit(record("ratelimit")).
+					StreamMetrics(record("metrics")).
+					StreamLogging(record("logging")).
+					StreamTrace(record("trace"))
+			},
+			want: []string{"trace", "logging", "metrics", "ratelimit"},
+		},
+		{
+			name: "skip nil",
+			builder: func() *ClientBuilder {
+				return NewClientBuilder(nil, "user").
+					StreamMetrics(record("metrics")).
+					Trace(func(ctx context.Context, method string, req, reply any,
+						cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+						return nil
+					})
+			},
+			want: []string{"metrics"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			order = nil
+			for _, interceptor := range tc.builder().streamInterceptors() {
+				_, _ = interceptor(context.Background(), nil, nil, "", nil)
+			}
+			assert.Equal(t, tc.want, order)
+		})
+	}
+}
+
+func TestClientBuilder_Build(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go func() {
+		_ = server.Serve(l)
+	}()
+	defer server.Stop()
+
+	var order []string
+	unary := func(name string) grpc.UnaryClientInterceptor {
+		return func(ctx context.Context, method string, req, reply any,
+			cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			order = append(order, name)
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+	}
+	stream := func(name string) grpc.StreamClientInterceptor {
+		return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+			method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			order = append(order, name)
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+	}
+	r := manual.NewBuilderWithScheme("test")
+	r.InitialState(resolver.State{Addresses: []resolver.Address{{Addr: l.Addr().String()}}})
+	// 设置的顺序和执行的顺序故意反过来,DialOptions 里面的拦截器排在最后
+	conn, err := NewClientBuilder(nil, "user").
+		Resolver(r).
+		DialOptions(grpc.WithChainUnaryInterceptor(unary("dial"))).
+		Retry(unary("retry")).
+		Timeout(unary("timeout")).
+		RateLimit(unary("ratelimit")).
+		Metrics(unary("metrics")).
+		Logging(unary("logging")).
+		Trace(unary("trace")).
+		StreamRateLimit(stream("ratelimit")).
+		StreamMetrics(stream("metrics")).
+		StreamLogging(stream("logging")).
+		StreamTrace(stream("trace")).
+		Build()
+	require.NoError(t, err)
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+	assert.Equal(t, []string{"trace", "logging", "metrics", "ratelimit", "timeout", "retry", "dial"}, order)
+
+	order = nil
+	ws, err := client.Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	_, err = ws.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"trace", "logging", "metrics", "ratelimit"}, order)
+
+	// 默认用的是 wrr,没有节点满足严格的标签就返回 Unavailable,pick_first 不会管标签
+	_, err = client.Check(balancerx.WithStrictLabels(context.Background(), "zone=none"),
+		&healthpb.HealthCheckRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
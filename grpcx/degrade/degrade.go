@@ -0,0 +1,84 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package degrade 在 context 里面传递降级信号
+// 限流, 熔断, 自适应限流之类的拦截器在放行模式下不会直接拒绝请求,
+// 而是设置降级信号,业务代码根据信号返回缓存或者部分数据
+package degrade
+
+import "context"
+
+// Level 降级的程度,越大降级越厉害
+type Level int
+
+const (
+	LevelNone Level = iota
+	// LevelPartial 只做核心逻辑,例如不查非核心的下游,可以返回部分数据
+	LevelPartial
+	// LevelFallback 不要再访问下游和数据库,返回缓存或者兜底数据
+	LevelFallback
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelNone:
+		return "none"
+	case LevelPartial:
+		return "partial"
+	case LevelFallback:
+		return "fallback"
+	default:
+		return "unknown"
+	}
+}
+
+// 设置降级信号的来源
+const (
+	ReasonRateLimit      = "ratelimit"
+	ReasonCircuitBreaker = "circuit_breaker"
+	ReasonOverload       = "overload"
+)
+
+type Signal struct {
+	Level  Level
+	Reason string
+}
+
+type signalKey struct{}
+
+// With 设置降级信号,已经有更严重的降级信号的时候保留原来的
+func With(ctx context.Context, level Level, reason string) context.Context {
+	if old, ok := FromContext(ctx); ok && old.Level >= level {
+		return ctx
+	}
+	return context.WithValue(ctx, signalKey{}, Signal{Level: level, Reason: reason})
+}
+
+func FromContext(ctx context.Context) (Signal, bool) {
+	sig, ok := ctx.Value(signalKey{}).(Signal)
+	return sig, ok
+}
+
+// LevelFromContext 没有降级信号的时候返回 LevelNone
+func LevelFromContext(ctx context.Context) Level {
+	sig, _ := FromContext(ctx)
+	return sig.Level
+}
+
+// IsLimited 是否需要降级
+func IsLimited(ctx context.Context) bool {
+	return LevelFromContext(ctx) > LevelNone
+}
@@ -0,0 +1,45 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package degrade
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWith(t *testing.T) {
+	ctx := context.Background()
+	assert.False(t, IsLimited(ctx))
+	assert.Equal(t, LevelNone, LevelFromContext(ctx))
+
+	ctx = With(ctx, LevelPartial, ReasonRateLimit)
+	assert.True(t, IsLimited(ctx))
+	assert.Equal(t, LevelPartial, LevelFromContext(ctx))
+
+	// 更严重的信号覆盖
+	ctx = With(ctx, LevelFallback, ReasonCircuitBreaker)
+	sig, ok := FromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, Signal{Level: LevelFallback, Reason: ReasonCircuitBreaker}, sig)
+
+	// 更轻的信号不会覆盖
+	ctx = With(ctx, LevelPartial, ReasonOverload)
+	sig, _ = FromContext(ctx)
+	assert.Equal(t, Signal{Level: LevelFallback, Reason: ReasonCircuitBreaker}, sig)
+}
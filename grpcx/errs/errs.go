@@ -0,0 +1,60 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package errs
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Class 把 gRPC 的错误码按照责任方归类
+type Class int
+
+const (
+	// ClassOK 调用成功
+	ClassOK Class = iota
+	// ClassClient 调用方自己的问题,例如参数错误,没有权限,主动取消
+	ClassClient
+	// ClassOverload 服务端过载,例如超时,资源耗尽
+	ClassOverload
+	// ClassServer 服务端出错,例如 Internal, Unavailable
+	ClassServer
+)
+
+// Classify 对错误归类
+func Classify(err error) Class {
+	return ClassifyCode(status.Code(err))
+}
+
+func ClassifyCode(code codes.Code) Class {
+	switch code {
+	case codes.OK:
+		return ClassOK
+	case codes.DeadlineExceeded, codes.ResourceExhausted:
+		return ClassOverload
+	case codes.Unknown, codes.Internal, codes.Unavailable, codes.DataLoss:
+		return ClassServer
+	default:
+		return ClassClient
+	}
+}
+
+// IsServerFault 是不是服务端的问题,熔断,重试,动态权重之类的只应该关心这一类错误
+func IsServerFault(err error) bool {
+	c := Classify(err)
+	return c == ClassOverload || c == ClassServer
+}
@@ -0,0 +1,283 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/bgq98/utils/ginx"
+	"github.com/bgq98/utils/grpcx/interceptors"
+	"github.com/bgq98/utils/logger"
+)
+
+const (
+	// HeaderAuthorization 用户的 token,格式是 Bearer xxx,和 HTTP 保持一致
+	HeaderAuthorization = "authorization"
+	// HeaderServiceToken 服务之间调用的凭证
+	HeaderServiceToken = "x-service-token"
+)
+
+// errEmptyKey key 为空的时候 golang-jwt 的 HMAC 会接受用空 key 伪造的 token
+var errEmptyKey = errors.New("auth: 服务端必须设置签发 jwt 的 key")
+
+type claimsKey struct{}
+type serviceKey struct{}
+type tokenKey struct{}
+
+// ClaimsFromContext 拿到调用方的用户信息,和 HTTP 一样是 ginx.UserClaims
+func ClaimsFromContext(ctx context.Context) (ginx.UserClaims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(ginx.UserClaims)
+	return claims, ok
+}
+
+// ServiceFromContext 通过服务凭证调用的时候,拿到调用方的服务名
+func ServiceFromContext(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(serviceKey{}).(string)
+	return name, ok
+}
+
+// WithToken 客户端显式指定要转发的用户 token
+func WithToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+// Rule 方法级别的鉴权规则
+type Rule struct {
+	// Pattern 写法见 interceptors.MatchMethod
+	Pattern string
+	// Public 不需要登录
+	Public bool
+	// VIP 只有 VIP 用户可以调用
+	VIP bool
+	// Roles 需要有其中一个角色,角色通过 InterceptorBuilder.Roles 计算
+	Roles []string
+	// UserOnly 只允许用户调用,不接受服务凭证
+	UserOnly bool
+}
+
+// InterceptorBuilder 服务端校验用户 token 或者服务凭证,客户端自动转发 token
+// 没有匹配上任何规则的方法要求登录(或者服务凭证)
+type InterceptorBuilder struct {
+	l            logger.Logger
+	key          []byte
+	services     map[string]string
+	serviceToken string
+	roles        func(ctx context.Context, claims ginx.UserClaims) []string
+	rules        []Rule
+}
+
+// NewInterceptorBuilder key 是签发 jwt 的 key,
+// BuildServer 和 BuildStreamServer 的时候 key 为空会直接 panic,BuildClient 用不到 key
+func NewInterceptorBuilder(l logger.Logger, key []byte) *InterceptorBuilder {
+	return &InterceptorBuilder{
+		l:        l,
+		key:      key,
+		services: make(map[string]string),
+		roles: func(ctx context.Context, claims ginx.UserClaims) []string {
+			return nil
+		},
+	}
+}
+
+// Service 服务端允许 name 服务使用 token 作为凭证调用
+func (b *InterceptorBuilder) Service(name string, token string) *InterceptorBuilder {
+	b.services[token] = name
+	return b
+}
+
+// ServiceToken 客户端调用的时候带上本服务的凭证
+func (b *InterceptorBuilder) ServiceToken(token string) *InterceptorBuilder {
+	b.serviceToken = token
+	return b
+}
+
+// Roles 计算用户的角色,例如从数据库或者缓存里面查
+func (b *InterceptorBuilder) Roles(fn func(ctx context.Context, claims ginx.UserClaims) []string) *InterceptorBuilder {
+	b.roles = fn
+	return b
+}
+
+// AddRule 按照添加的顺序匹配,只有第一条匹配上的规则生效
+func (b *InterceptorBuilder) AddRule(rule Rule) *InterceptorBuilder {
+	b.rules = append(b.rules, rule)
+	return b
+}
+
+func (b *InterceptorBuilder) BuildServer() grpc.UnaryServerInterceptor {
+	b.mustHaveKey()
+	return func(ctx context.Context,
+		req any, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (resp any, err error) {
+		ctx, err = b.authenticate(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (b *InterceptorBuilder) BuildStreamServer() grpc.StreamServerInterceptor {
+	b.mustHaveKey()
+	return func(srv any, ss grpc.ServerStream,
+		info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := b.authenticate(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, interceptors.NewServerStream(ss).WithContext(ctx))
+	}
+}
+
+func (b *InterceptorBuilder) mustHaveKey() {
+	if len(b.key) == 0 {
+		panic(errEmptyKey)
+	}
+}
+
+// BuildClient 把调用方的 token 转发下去
+// token 的来源依次是 WithToken, *gin.Context 的 Authorization 头部, 上游 gRPC 请求的 authorization
+func (b *InterceptorBuilder) BuildClient() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context,
+		method string, req, reply any,
+		cc *grpc.ClientConn, invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption) error {
+		return invoker(b.outgoing(ctx), method, req, reply, cc, opts...)
+	}
+}
+
+func (b *InterceptorBuilder) outgoing(ctx context.Context) context.Context {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	if len(md.Get(HeaderAuthorization)) == 0 {
+		if token := b.callerToken(ctx); token != "" {
+			md.Set(HeaderAuthorization, "Bearer "+token)
+		}
+	}
+	if b.serviceToken != "" {
+		md.Set(HeaderServiceToken, b.serviceToken)
+	}
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+func (b *InterceptorBuilder) callerToken(ctx context.Context) string {
+	if token, ok := ctx.Value(tokenKey{}).(string); ok {
+		return token
+	}
+	// 前面的拦截器(例如 trace)可能已经把 *gin.Context 包了一层
+	if gc, ok := ctx.Value(gin.ContextKey).(*gin.Context); ok && gc.Request != nil {
+		return bearer(gc.GetHeader("Authorization"))
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if vals := md.Get(HeaderAuthorization); len(vals) > 0 {
+			return bearer(vals[0])
+		}
+	}
+	return ""
+}
+
+func (b *InterceptorBuilder) authenticate(ctx context.Context, method string) (context.Context, error) {
+	rule := b.match(method)
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	if vals := md.Get(HeaderServiceToken); len(vals) > 0 {
+		name, ok := b.services[vals[0]]
+		if !ok {
+			b.l.Warn("服务凭证不对", logger.String("method", method))
+			return ctx, status.Error(codes.Unauthenticated, "服务凭证不对")
+		}
+		ctx = context.WithValue(ctx, serviceKey{}, name)
+	}
+
+	var token string
+	if vals := md.Get(HeaderAuthorization); len(vals) > 0 {
+		token = bearer(vals[0])
+	}
+	if token == "" {
+		if rule.Public {
+			return ctx, nil
+		}
+		if _, ok := ServiceFromContext(ctx); ok && !rule.UserOnly && !rule.VIP && len(rule.Roles) == 0 {
+			// 服务之间的调用,没有用户信息
+			return ctx, nil
+		}
+		return ctx, status.Error(codes.Unauthenticated, "未登录")
+	}
+
+	var claims ginx.UserClaims
+	tk, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		if len(b.key) == 0 {
+			return nil, errEmptyKey
+		}
+		return b.key, nil
+	}, jwt.WithValidMethods([]string{"HS256", "HS384", "HS512"}))
+	if err != nil || !tk.Valid {
+		if rule.Public {
+			// 公开的接口 token 不对也放过去,只是拿不到用户信息
+			return ctx, nil
+		}
+		b.l.Warn("token 不对", logger.String("method", method), logger.Error(err))
+		return ctx, status.Error(codes.Unauthenticated, "token 不对")
+	}
+	ctx = context.WithValue(ctx, claimsKey{}, claims)
+	if rule.Public {
+		return ctx, nil
+	}
+	if rule.VIP && !claims.VIP {
+		return ctx, status.Error(codes.PermissionDenied, "只有 VIP 才能访问")
+	}
+	if len(rule.Roles) > 0 && !hasAnyRole(b.roles(ctx, claims), rule.Roles) {
+		return ctx, status.Error(codes.PermissionDenied, "没有权限")
+	}
+	return ctx, nil
+}
+
+func (b *InterceptorBuilder) match(method string) Rule {
+	for _, rule := range b.rules {
+		if interceptors.MatchMethod(rule.Pattern, method) {
+			return rule
+		}
+	}
+	return Rule{}
+}
+
+func bearer(val string) string {
+	token, ok := strings.CutPrefix(val, "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+func hasAnyRole(roles []string, want []string) bool {
+	for _, r := range roles {
+		for _, w := range want {
+			if r == w {
+				return true
+			}
+		}
+	}
+	return false
+}
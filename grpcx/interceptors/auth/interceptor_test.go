@@ -0,0 +1,214 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/bgq98/utils/ginx"
+	"github.com/bgq98/utils/logger"
+)
+
+var key = []byte("test-key")
+
+func TestInterceptorBuilder_BuildServer(t *testing.T) {
+	token := func(vip bool) string {
+		tk := jwt.NewWithClaims(jwt.SigningMethodHS512, ginx.UserClaims{
+			Id:  123,
+			VIP: vip,
+			RegisteredClaims: jwt.RegisteredClaims{
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+			},
+		})
+		str, err := tk.SignedString(key)
+		require.NoError(t, err)
+		return "Bearer " + str
+	}
+	testCases := []struct {
+		name     string
+		method   string
+		md       metadata.MD
+		wantCode codes.Code
+		wantUid  int64
+	}{
+		{
+			name:     "no token",
+			method:   "/user.v1.UserService/Profile",
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:    "user",
+			method:  "/user.v1.UserService/Profile",
+			md:      metadata.Pairs(HeaderAuthorization, token(false)),
+			wantUid: 123,
+		},
+		{
+			name:     "bad token",
+			method:   "/user.v1.UserService/Profile",
+			md:       metadata.Pairs(HeaderAuthorization, "Bearer abc"),
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:   "public",
+			method: "/user.v1.UserService/Login",
+		},
+		{
+			name:     "not vip",
+			method:   "/user.v1.UserService/Vip",
+			md:       metadata.Pairs(HeaderAuthorization, token(false)),
+			wantCode: codes.PermissionDenied,
+		},
+		{
+			name:    "vip",
+			method:  "/user.v1.UserService/Vip",
+			md:      metadata.Pairs(HeaderAuthorization, token(true)),
+			wantUid: 123,
+		},
+		{
+			name:   "service",
+			method: "/user.v1.UserService/Profile",
+			md:     metadata.Pairs(HeaderServiceToken, "svc-token"),
+		},
+		{
+			name:     "service not allowed",
+			method:   "/user.v1.UserService/Admin",
+			md:       metadata.Pairs(HeaderServiceToken, "svc-token"),
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:     "bad service token",
+			method:   "/user.v1.UserService/Profile",
+			md:       metadata.Pairs(HeaderServiceToken, "abc"),
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:    "role",
+			method:  "/user.v1.UserService/Admin",
+			md:      metadata.Pairs(HeaderAuthorization, token(true)),
+			wantUid: 123,
+		},
+		{
+			name:     "no role",
+			method:   "/user.v1.UserService/Admin",
+			md:       metadata.Pairs(HeaderAuthorization, token(false)),
+			wantCode: codes.PermissionDenied,
+		},
+	}
+	interceptor := NewInterceptorBuilder(logger.NewNoOpLogger(), key).
+		Service("order", "svc-token").
+		Roles(func(ctx context.Context, claims ginx.UserClaims) []string {
+			if claims.VIP {
+				return []string{"admin"}
+			}
+			return nil
+		}).
+		AddRule(Rule{Pattern: "/user.v1.UserService/Login", Public: true}).
+		AddRule(Rule{Pattern: "/user.v1.UserService/Vip", VIP: true}).
+		AddRule(Rule{Pattern: "/user.v1.UserService/Admin", Roles: []string{"admin"}, UserOnly: true}).
+		BuildServer()
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), tc.md)
+			var uid int64
+			_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: tc.method},
+				func(ctx context.Context, req any) (any, error) {
+					claims, _ := ClaimsFromContext(ctx)
+					uid = claims.Id
+					return nil, nil
+				})
+			assert.Equal(t, tc.wantCode, status.Code(err))
+			assert.Equal(t, tc.wantUid, uid)
+		})
+	}
+}
+
+func TestInterceptorBuilder_BuildClient(t *testing.T) {
+	interceptor := NewInterceptorBuilder(logger.NewNoOpLogger(), nil).
+		ServiceToken("svc-token").
+		BuildClient()
+	ctx := metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs(HeaderAuthorization, "Bearer abc"))
+	err := interceptor(ctx, "/user.v1.UserService/Profile", nil, nil, nil,
+		func(ctx context.Context, method string, req, reply any,
+			cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			md, _ := metadata.FromOutgoingContext(ctx)
+			assert.Equal(t, []string{"Bearer abc"}, md.Get(HeaderAuthorization))
+			assert.Equal(t, []string{"svc-token"}, md.Get(HeaderServiceToken))
+			return nil
+		})
+	assert.NoError(t, err)
+}
+
+func TestInterceptorBuilder_emptyKey(t *testing.T) {
+	b := NewInterceptorBuilder(logger.NewNoOpLogger(), nil)
+	assert.PanicsWithValue(t, errEmptyKey, func() {
+		b.BuildServer()
+	})
+	assert.PanicsWithValue(t, errEmptyKey, func() {
+		b.BuildStreamServer()
+	})
+	assert.NotPanics(t, func() {
+		b.BuildClient()
+	})
+
+	// 绕过 BuildServer,用空 key 伪造的 token 也不能通过校验
+	tk := jwt.NewWithClaims(jwt.SigningMethodHS256, ginx.UserClaims{
+		Id: 123,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+	})
+	forged, err := tk.SignedString([]byte{})
+	require.NoError(t, err)
+	ctx := metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs(HeaderAuthorization, "Bearer "+forged))
+	_, err = b.authenticate(ctx, "/user.v1.UserService/Profile")
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+// TestInterceptorBuilder_BuildClient_gin *gin.Context 被前面的拦截器包了一层,也要能拿到 Authorization
+func TestInterceptorBuilder_BuildClient_gin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	gc, _ := gin.CreateTestContext(httptest.NewRecorder())
+	gc.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	gc.Request.Header.Set("Authorization", "Bearer abc")
+	type wrapKey struct{}
+	ctx := context.WithValue(gc, wrapKey{}, "trace")
+
+	interceptor := NewInterceptorBuilder(logger.NewNoOpLogger(), nil).BuildClient()
+	err := interceptor(ctx, "/user.v1.UserService/Profile", nil, nil, nil,
+		func(ctx context.Context, method string, req, reply any,
+			cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			md, _ := metadata.FromOutgoingContext(ctx)
+			assert.Equal(t, []string{"Bearer abc"}, md.Get(HeaderAuthorization))
+			return nil
+		})
+	assert.NoError(t, err)
+}
@@ -25,17 +25,23 @@ import (
 	"google.golang.org/grpc/peer"
 )
 
+// 调用方通过这两个 metadata 传递身份,identity 包里面的客户端拦截器会设置
+const (
+	HeaderApp      = "app"
+	HeaderClientIP = "client-ip"
+)
+
 type Builder struct {
 }
 
 // PeerName 获取对端应用名称
 func (s *Builder) PeerName(ctx context.Context) string {
-	return s.grpcHeaderValue(ctx, "app")
+	return s.grpcHeaderValue(ctx, HeaderApp)
 }
 
-// PeerIP 获取对端 ip
+// PeerIP 获取对端 ip,优先使用调用方传过来的最初发起请求的 ip
 func (s *Builder) PeerIP(ctx context.Context) string {
-	clientIP := s.grpcHeaderValue(ctx, "client-ip")
+	clientIP := s.grpcHeaderValue(ctx, HeaderClientIP)
 	if clientIP != "" {
 		return clientIP
 	}
@@ -47,11 +53,12 @@ func (s *Builder) PeerIP(ctx context.Context) string {
 	if pr.Addr == net.Addr(nil) {
 		return ""
 	}
-	addSlice := strings.Split(pr.Addr.String(), ":")
-	if len(addSlice) > 1 {
-		return addSlice[0]
+	// IPv6 的地址是 [::1]:8080 这种格式,不能直接按照冒号切割
+	host, _, err := net.SplitHostPort(pr.Addr.String())
+	if err != nil {
+		return ""
 	}
-	return ""
+	return host
 }
 
 // 解析 grpc 头部值
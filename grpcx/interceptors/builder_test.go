@@ -0,0 +1,66 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package interceptors
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+func TestBuilder_PeerIP(t *testing.T) {
+	testCases := []struct {
+		name string
+		ctx  context.Context
+		want string
+	}{
+		{
+			name: "client-ip",
+			ctx: metadata.NewIncomingContext(context.Background(),
+				metadata.Pairs(HeaderClientIP, "10.0.0.1")),
+			want: "10.0.0.1",
+		},
+		{
+			name: "ipv4",
+			ctx: peer.NewContext(context.Background(), &peer.Peer{
+				Addr: &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 8080},
+			}),
+			want: "192.168.1.1",
+		},
+		{
+			name: "ipv6",
+			ctx: peer.NewContext(context.Background(), &peer.Peer{
+				Addr: &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 8080},
+			}),
+			want: "fe80::1",
+		},
+		{
+			name: "no peer",
+			ctx:  context.Background(),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &Builder{}
+			assert.Equal(t, tc.want, b.PeerIP(tc.ctx))
+		})
+	}
+}
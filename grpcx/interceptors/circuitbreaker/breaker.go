@@ -0,0 +1,240 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package circuitbreaker
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrOpen 熔断器打开了,请求不允许通过
+var ErrOpen = errors.New("circuit breaker is open")
+
+type State int32
+
+const (
+	StateClosed State = iota
+	StateOpen
+	StateHalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half_open"
+	default:
+		return "unknown"
+	}
+}
+
+// Config 熔断器的参数
+// 滑动窗口内请求数达到 MinRequests 之后,失败率或者慢调用比例超过阈值就打开,
+// 打开 OpenTimeout 之后进入半开,放 HalfOpenRequests 个请求过去探测,
+// 全部成功就关闭,有一个失败就重新打开
+type Config struct {
+	// Window 滑动窗口的大小,会被分成 Buckets 个桶
+	Window  time.Duration
+	Buckets int
+	// MinRequests 窗口内请求数太少的时候失败率没有意义
+	MinRequests int
+	// ErrorRate 失败率阈值,例如 0.5
+	ErrorRate float64
+	// SlowCallDuration 超过这个耗时就算慢调用,0 代表不统计慢调用
+	SlowCallDuration time.Duration
+	// SlowCallRate 慢调用比例阈值
+	SlowCallRate float64
+	// OpenTimeout 打开多久之后进入半开
+	OpenTimeout time.Duration
+	// HalfOpenRequests 半开的时候允许通过的探测请求数
+	HalfOpenRequests int
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Window:           time.Second * 10,
+		Buckets:          10,
+		MinRequests:      20,
+		ErrorRate:        0.5,
+		SlowCallDuration: time.Second,
+		SlowCallRate:     0.8,
+		OpenTimeout:      time.Second * 5,
+		HalfOpenRequests: 5,
+	}
+}
+
+// Breaker 一个熔断器,并发安全
+type Breaker struct {
+	cfg           Config
+	bucketWidth   time.Duration
+	now           func() time.Time
+	onStateChange func(from, to State)
+
+	lock     sync.Mutex
+	state    State
+	buckets  []bucket
+	openedAt time.Time
+	// 半开状态下已经放过去的请求数和成功数
+	probes    int
+	successes int
+}
+
+type bucket struct {
+	// idx 桶对应的时间片,用来判断桶是不是过期了
+	idx    int64
+	total  int
+	failed int
+	slow   int
+}
+
+// NewBreaker onStateChange 会在持有锁的情况下调用,不要在里面调用 Breaker 的方法
+func NewBreaker(cfg Config, onStateChange func(from, to State)) *Breaker {
+	if cfg.Buckets <= 0 {
+		cfg.Buckets = 10
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = time.Second * 10
+	}
+	if cfg.HalfOpenRequests <= 0 {
+		cfg.HalfOpenRequests = 1
+	}
+	if onStateChange == nil {
+		onStateChange = func(from, to State) {}
+	}
+	return &Breaker{
+		cfg:           cfg,
+		bucketWidth:   cfg.Window / time.Duration(cfg.Buckets),
+		now:           time.Now,
+		onStateChange: onStateChange,
+		buckets:       make([]bucket, cfg.Buckets),
+	}
+}
+
+func (b *Breaker) State() State {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.checkOpenTimeout()
+	return b.state
+}
+
+// Allow 返回 ErrOpen 代表请求不能通过
+// 返回 nil 的话,调用结束之后一定要调用 Mark
+func (b *Breaker) Allow() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.checkOpenTimeout()
+	switch b.state {
+	case StateOpen:
+		return ErrOpen
+	case StateHalfOpen:
+		if b.probes >= b.cfg.HalfOpenRequests {
+			return ErrOpen
+		}
+		b.probes++
+	}
+	return nil
+}
+
+// Mark 记录调用结果
+func (b *Breaker) Mark(failed bool, duration time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	slow := b.cfg.SlowCallDuration > 0 && duration > b.cfg.SlowCallDuration
+	switch b.state {
+	case StateHalfOpen:
+		if failed || slow {
+			b.setState(StateOpen)
+			return
+		}
+		b.successes++
+		if b.successes >= b.cfg.HalfOpenRequests {
+			b.setState(StateClosed)
+		}
+	case StateClosed:
+		bk := b.current()
+		bk.total++
+		if failed {
+			bk.failed++
+		}
+		if slow {
+			bk.slow++
+		}
+		if b.shouldOpen() {
+			b.setState(StateOpen)
+		}
+	}
+	// 打开状态下的结果是打开之前放过去的请求,忽略
+}
+
+func (b *Breaker) checkOpenTimeout() {
+	if b.state == StateOpen && b.now().Sub(b.openedAt) >= b.cfg.OpenTimeout {
+		b.setState(StateHalfOpen)
+	}
+}
+
+func (b *Breaker) setState(state State) {
+	if b.state == state {
+		return
+	}
+	from := b.state
+	b.state = state
+	b.probes, b.successes = 0, 0
+	switch state {
+	case StateOpen:
+		b.openedAt = b.now()
+	case StateClosed:
+		// 重新开始统计
+		for i := range b.buckets {
+			b.buckets[i] = bucket{}
+		}
+	}
+	b.onStateChange(from, state)
+}
+
+// current 当前时间对应的桶,过期的桶会被清空
+func (b *Breaker) current() *bucket {
+	idx := b.now().UnixNano() / int64(b.bucketWidth)
+	bk := &b.buckets[idx%int64(len(b.buckets))]
+	if bk.idx != idx {
+		*bk = bucket{idx: idx}
+	}
+	return bk
+}
+
+func (b *Breaker) shouldOpen() bool {
+	minIdx := b.now().UnixNano()/int64(b.bucketWidth) - int64(len(b.buckets)) + 1
+	var total, failed, slow int
+	for _, bk := range b.buckets {
+		if bk.idx < minIdx {
+			continue
+		}
+		total += bk.total
+		failed += bk.failed
+		slow += bk.slow
+	}
+	if total == 0 || total < b.cfg.MinRequests {
+		return false
+	}
+	if b.cfg.ErrorRate > 0 && float64(failed)/float64(total) >= b.cfg.ErrorRate {
+		return true
+	}
+	return b.cfg.SlowCallRate > 0 && float64(slow)/float64(total) >= b.cfg.SlowCallRate
+}
@@ -0,0 +1,232 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package circuitbreaker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/bgq98/utils/grpcx/degrade"
+	"github.com/bgq98/utils/logger"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	var transitions []string
+	b := NewBreaker(Config{
+		Window:           time.Second * 10,
+		Buckets:          10,
+		MinRequests:      4,
+		ErrorRate:        0.5,
+		SlowCallDuration: time.Second,
+		SlowCallRate:     0.8,
+		OpenTimeout:      time.Second * 5,
+		HalfOpenRequests: 2,
+	}, func(from, to State) {
+		transitions = append(transitions, from.String()+"->"+to.String())
+	})
+	b.now = func() time.Time { return now }
+
+	// 请求数不够,不会打开
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, b.Allow())
+		b.Mark(true, time.Millisecond)
+	}
+	assert.Equal(t, StateClosed, b.State())
+
+	// 过了窗口之后旧的失败不算
+	now = now.Add(time.Second * 11)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, b.Allow())
+		b.Mark(false, time.Millisecond)
+	}
+	assert.NoError(t, b.Allow())
+	b.Mark(true, time.Millisecond)
+	assert.Equal(t, StateClosed, b.State())
+
+	// 失败率到了 50%
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, b.Allow())
+		b.Mark(true, time.Millisecond)
+	}
+	assert.Equal(t, StateOpen, b.State())
+	assert.Equal(t, ErrOpen, b.Allow())
+
+	// 半开,只放两个请求
+	now = now.Add(time.Second * 5)
+	assert.NoError(t, b.Allow())
+	assert.NoError(t, b.Allow())
+	assert.Equal(t, ErrOpen, b.Allow())
+	// 探测的慢调用也算失败
+	b.Mark(false, time.Second*2)
+	assert.Equal(t, StateOpen, b.State())
+
+	now = now.Add(time.Second * 5)
+	assert.NoError(t, b.Allow())
+	assert.NoError(t, b.Allow())
+	b.Mark(false, time.Millisecond)
+	b.Mark(false, time.Millisecond)
+	assert.Equal(t, StateClosed, b.State())
+
+	assert.Equal(t, []string{
+		"closed->open", "open->half_open", "half_open->open",
+		"open->half_open", "half_open->closed",
+	}, transitions)
+}
+
+func TestInterceptorBuilder_BuildServerInterceptor(t *testing.T) {
+	testCases := []struct {
+		name        string
+		passThrough bool
+		wantCode    codes.Code
+		wantLevel   degrade.Level
+	}{
+		{
+			name:     "拒绝",
+			wantCode: codes.Unavailable,
+		},
+		{
+			name:        "放行",
+			passThrough: true,
+			wantLevel:   degrade.LevelFallback,
+		},
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/user.v1.UserService/GetById"}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := NewInterceptorBuilder(logger.NewNoOpLogger(), Config{
+				MinRequests: 2,
+				ErrorRate:   0.5,
+				OpenTimeout: time.Minute,
+			}).PassThrough(tc.passThrough)
+			interceptor := b.BuildServerInterceptor()
+			// 两次服务端错误,熔断器打开
+			for i := 0; i < 2; i++ {
+				_, err := interceptor(context.Background(), nil, info,
+					func(ctx context.Context, req any) (any, error) {
+						return nil, status.Error(codes.Internal, "数据库错误")
+					})
+				assert.Equal(t, codes.Internal, status.Code(err))
+			}
+			breaker := b.breaker("server", info.FullMethod)
+			assert.Equal(t, StateOpen, breaker.State())
+
+			var called bool
+			_, err := interceptor(context.Background(), nil, info,
+				func(ctx context.Context, req any) (any, error) {
+					called = true
+					assert.Equal(t, tc.wantLevel, degrade.LevelFromContext(ctx))
+					return nil, nil
+				})
+			assert.Equal(t, tc.wantCode, status.Code(err))
+			assert.Equal(t, tc.passThrough, called)
+			// 放行的请求不计入熔断器
+			assert.Equal(t, StateOpen, breaker.State())
+		})
+	}
+}
+
+// TestInterceptorBuilder_panic panic 也要 Mark,不然半开状态的探测名额一直占着,熔断器卡在半开
+func TestInterceptorBuilder_panic(t *testing.T) {
+	cc, err := grpc.Dial("passthrough:///user", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer cc.Close()
+	const method = "/user.v1.UserService/GetById"
+	testCases := []struct {
+		name string
+		// call 调用一次拦截器, fn 是业务代码
+		call func(b *InterceptorBuilder, fn func() error) error
+		key  func() (string, string)
+	}{
+		{
+			name: "server",
+			call: func(b *InterceptorBuilder, fn func() error) error {
+				_, err := b.BuildServerInterceptor()(context.Background(), nil,
+					&grpc.UnaryServerInfo{FullMethod: method},
+					func(ctx context.Context, req any) (any, error) {
+						return nil, fn()
+					})
+				return err
+			},
+			key: func() (string, string) {
+				return "server", method
+			},
+		},
+		{
+			name: "client",
+			call: func(b *InterceptorBuilder, fn func() error) error {
+				return b.BuildClientInterceptor()(context.Background(), method, nil, nil, cc,
+					func(ctx context.Context, method string, req, reply any,
+						cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+						return fn()
+					})
+			},
+			key: func() (string, string) {
+				return "client", cc.Target() + method
+			},
+		},
+	}
+	panicking := func() error {
+		panic("数据库炸了")
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := NewInterceptorBuilder(logger.NewNoOpLogger(), Config{
+				MinRequests:      1,
+				ErrorRate:        0.5,
+				OpenTimeout:      time.Minute,
+				HalfOpenRequests: 1,
+			})
+			// 拦截器还没有创建,指标要先注册,不然拿不到熔断器
+			b.initMetrics()
+			breaker := b.breaker(tc.key())
+			now := time.Now()
+			breaker.now = func() time.Time {
+				return now
+			}
+
+			// panic 算失败,继续往外抛
+			assert.PanicsWithValue(t, "数据库炸了", func() {
+				_ = tc.call(b, panicking)
+			})
+			assert.Equal(t, StateOpen, breaker.State())
+
+			// 半开的探测请求 panic 了,重新打开
+			now = now.Add(time.Minute)
+			assert.Equal(t, StateHalfOpen, breaker.State())
+			assert.Panics(t, func() {
+				_ = tc.call(b, panicking)
+			})
+			assert.Equal(t, StateOpen, breaker.State())
+
+			// 再次半开,探测名额没有被占着,成功之后关闭
+			now = now.Add(time.Minute)
+			assert.NoError(t, tc.call(b, func() error {
+				return nil
+			}))
+			assert.Equal(t, StateClosed, breaker.State())
+		})
+	}
+}
@@ -18,59 +18,140 @@ package circuitbreaker
 
 import (
 	"context"
-	rand2 "math/rand"
+	"sync"
+	"time"
 
-	"github.com/go-kratos/aegis/circuitbreaker"
+	"github.com/prometheus/client_golang/prometheus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bgq98/utils/grpcx/degrade"
+	"github.com/bgq98/utils/grpcx/errs"
+	"github.com/bgq98/utils/internal/metrics"
+	"github.com/bgq98/utils/logger"
 )
 
+// InterceptorBuilder 每个方法一个熔断器,客户端是每个目标服务的每个方法一个
+// 只有服务端的问题(Internal, Unavailable, DeadlineExceeded 等)才算失败,
+// 参数错误之类的是调用方的问题,不应该触发熔断
 type InterceptorBuilder struct {
-	breaker   circuitbreaker.CircuitBreaker
-	threshold int // 标记位 触发熔断就置为 0
+	cfg         Config
+	l           logger.Logger
+	passThrough bool
+	lock        sync.Mutex
+	breakers    map[string]*Breaker
+
+	registerer        prometheus.Registerer
+	once              sync.Once
+	stateGauge        *prometheus.GaugeVec
+	transitionCounter *prometheus.CounterVec
+}
+
+func NewInterceptorBuilder(l logger.Logger, cfg Config) *InterceptorBuilder {
+	return &InterceptorBuilder{
+		cfg:      cfg,
+		l:        l,
+		breakers: make(map[string]*Breaker),
+	}
+}
+
+// PassThrough 放行模式,只对服务端生效
+// 熔断的时候不拒绝请求,而是设置 degrade.LevelFallback 的降级信号,由业务返回兜底数据
+func (s *InterceptorBuilder) PassThrough(ok bool) *InterceptorBuilder {
+	s.passThrough = ok
+	return s
+}
+
+// Registerer 不设置就注册到 prometheus.DefaultRegisterer
+func (s *InterceptorBuilder) Registerer(r prometheus.Registerer) *InterceptorBuilder {
+	s.registerer = r
+	return s
+}
+
+// initMetrics 用到的时候才注册,只 import 不会注册指标
+func (s *InterceptorBuilder) initMetrics() {
+	s.once.Do(func() {
+		s.stateGauge = metrics.Register(s.registerer, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "grpcx_circuit_breaker_state",
+			Help: "熔断器状态,0 关闭,1 打开,2 半开",
+		}, []string{"side", "key"}))
+		s.transitionCounter = metrics.Register(s.registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpcx_circuit_breaker_transitions_total",
+			Help: "熔断器状态变化次数",
+		}, []string{"side", "key", "from", "to"}))
+	})
 }
 
-// BuildServerInterceptor 默认 kratos 熔断
-func (s *InterceptorBuilder) BuildServerDefaultInterceptor() grpc.UnaryServerInterceptor {
+// BuildServerInterceptor 按照 FullMethod 熔断
+func (s *InterceptorBuilder) BuildServerInterceptor() grpc.UnaryServerInterceptor {
+	s.initMetrics()
 	return func(ctx context.Context,
 		req any, info *grpc.UnaryServerInfo,
 		handler grpc.UnaryHandler) (resp any, err error) {
-		// 判断请求是否允许发送
-		if s.breaker.Allow() == nil {
-			resp, err = handler(ctx, req)
-			if err != nil {
-				s.breaker.MarkFailed()
-			} else {
-				s.breaker.MarkSuccess()
+		breaker := s.breaker("server", info.FullMethod)
+		if breaker.Allow() != nil {
+			if s.passThrough {
+				// 没有占用探测的名额,结果也不计入熔断器
+				return handler(degrade.With(ctx, degrade.LevelFallback, degrade.ReasonCircuitBreaker), req)
 			}
+			return nil, status.Errorf(codes.Unavailable, "触发熔断")
 		}
-		s.breaker.MarkFailed()
-		// 触发了熔断器
-		return nil, err
+		start := time.Now()
+		defer func() {
+			mark(breaker, start, err, recover())
+		}()
+		resp, err = handler(ctx, req)
+		return
 	}
 }
 
-func (s *InterceptorBuilder) BuildServerThresholdInterceptor() grpc.UnaryServerInterceptor {
+// BuildClientInterceptor 按照目标服务 + 方法熔断
+func (s *InterceptorBuilder) BuildClientInterceptor() grpc.UnaryClientInterceptor {
+	s.initMetrics()
 	return func(ctx context.Context,
-		req any, info *grpc.UnaryServerInfo,
-		handler grpc.UnaryHandler) (resp any, err error) {
-		if !s.allow() {
-			s.threshold = s.threshold / 2
+		method string, req, reply any,
+		cc *grpc.ClientConn, invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption) (err error) {
+		breaker := s.breaker("client", cc.Target()+method)
+		if breaker.Allow() != nil {
+			return status.Errorf(codes.Unavailable, "触发熔断")
 		}
+		start := time.Now()
+		defer func() {
+			mark(breaker, start, err, recover())
+		}()
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
 
-		rand := rand2.Intn(100)
-		if rand <= s.threshold {
-			resp, err = handler(ctx, req)
-			if err == nil && s.threshold != 0 {
-				// 要考虑调大 threshold 说明业务正常
-				s.threshold = s.threshold * 2
-			} else if s.threshold != 0 {
-				// 要考虑调大 threshold
-			}
-		}
-		return
+// mark Allow 通过之后不管怎么结束都要 Mark,不然半开状态的探测名额就一直占着,熔断器再也关不上
+// panic 算作失败,记录之后继续往外抛
+func mark(breaker *Breaker, start time.Time, err error, r any) {
+	if r != nil {
+		breaker.Mark(true, time.Since(start))
+		panic(r)
 	}
+	breaker.Mark(errs.IsServerFault(err), time.Since(start))
 }
 
-func (s *InterceptorBuilder) allow() bool {
-	return false
+func (s *InterceptorBuilder) breaker(side, key string) *Breaker {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	b, ok := s.breakers[side+":"+key]
+	if ok {
+		return b
+	}
+	s.stateGauge.WithLabelValues(side, key).Set(float64(StateClosed))
+	b = NewBreaker(s.cfg, func(from, to State) {
+		s.stateGauge.WithLabelValues(side, key).Set(float64(to))
+		s.transitionCounter.WithLabelValues(side, key, from.String(), to.String()).Inc()
+		s.l.Warn("熔断器状态变化",
+			logger.String("side", side),
+			logger.String("key", key),
+			logger.String("from", from.String()),
+			logger.String("to", to.String()))
+	})
+	s.breakers[side+":"+key] = b
+	return b
 }
@@ -0,0 +1,165 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package fault 故障注入,用来演练依赖故障
+package fault
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/bgq98/utils/grpcx/interceptors"
+	"github.com/bgq98/utils/logger"
+	"github.com/bgq98/utils/syncx/atomicx"
+)
+
+// HeaderFault 带了这个 metadata 的流量才会被 Rule.Tagged 的规则命中
+const HeaderFault = "x-fault-injection"
+
+// WithTag 把这次调用标记为测试流量
+func WithTag(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, HeaderFault, "true")
+}
+
+// Rule 故障规则,按照顺序匹配方法和标记,只用第一个匹配上的
+type Rule struct {
+	// Pattern 方法,支持 * 和前缀匹配,见 interceptors.MatchMethod
+	Pattern string
+	// Percent 命中的比例,0-100
+	Percent float64
+	// Tagged 只对带了 HeaderFault 的流量生效
+	Tagged bool
+	// Delay 注入延迟,会在返回错误之前
+	Delay time.Duration
+	// Code 不是 OK 的时候返回这个错误码
+	// Abort 为 false 的时候会正常调用,再把结果替换成错误,模拟处理成功但是响应丢失;
+	// Abort 为 true 的时候直接返回,不会调用下去,Code 没有设置的时候是 Aborted
+	Code  codes.Code
+	Abort bool
+}
+
+// InterceptorBuilder 规则可以在运行期间通过 SetRules 切换
+type InterceptorBuilder struct {
+	l     logger.Logger
+	rules *atomicx.Value[[]Rule]
+	rand  func() float64
+}
+
+func NewInterceptorBuilder(l logger.Logger, rules ...Rule) *InterceptorBuilder {
+	return &InterceptorBuilder{
+		l:     l,
+		rules: atomicx.NewValueOf[[]Rule](rules),
+		rand:  rand.Float64,
+	}
+}
+
+// SetRules 替换全部规则,不传就是关闭故障注入
+func (s *InterceptorBuilder) SetRules(rules ...Rule) {
+	s.rules.Store(rules)
+}
+
+func (s *InterceptorBuilder) BuildServer() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context,
+		req any, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (resp any, err error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		rule, ok := s.match(info.FullMethod, md)
+		if !ok {
+			return handler(ctx, req)
+		}
+		err = s.inject(ctx, "server", info.FullMethod, rule, func() error {
+			resp, err = handler(ctx, req)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+}
+
+func (s *InterceptorBuilder) BuildClient() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context,
+		method string, req, reply any,
+		cc *grpc.ClientConn, invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption) error {
+		// 测试流量的标记可能是自己设置的,也可能是上游传过来的
+		md, _ := metadata.FromOutgoingContext(ctx)
+		if in, ok := metadata.FromIncomingContext(ctx); ok {
+			md = metadata.Join(md, in)
+		}
+		rule, ok := s.match(method, md)
+		if !ok {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		return s.inject(ctx, "client", method, rule, func() error {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		})
+	}
+}
+
+func (s *InterceptorBuilder) match(method string, md metadata.MD) (Rule, bool) {
+	for _, rule := range s.rules.Load() {
+		if !interceptors.MatchMethod(rule.Pattern, method) {
+			continue
+		}
+		if rule.Tagged && len(md.Get(HeaderFault)) == 0 {
+			continue
+		}
+		if s.rand()*100 >= rule.Percent {
+			return Rule{}, false
+		}
+		return rule, true
+	}
+	return Rule{}, false
+}
+
+func (s *InterceptorBuilder) inject(ctx context.Context, side, method string,
+	rule Rule, call func() error) error {
+	code := rule.Code
+	if rule.Abort && code == codes.OK {
+		code = codes.Aborted
+	}
+	s.l.Warn("注入故障",
+		logger.String("side", side),
+		logger.String("method", method),
+		logger.Int64("delay", rule.Delay.Milliseconds()),
+		logger.String("code", code.String()),
+		logger.Bool("abort", rule.Abort))
+
+	if rule.Delay > 0 {
+		timer := time.NewTimer(rule.Delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return status.FromContextError(ctx.Err()).Err()
+		case <-timer.C:
+		}
+	}
+	if !rule.Abort {
+		err := call()
+		if code == codes.OK || err != nil {
+			return err
+		}
+	}
+	return status.Error(code, "注入的故障")
+}
@@ -0,0 +1,127 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fault
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/bgq98/utils/logger"
+)
+
+func TestInterceptorBuilder_BuildServer(t *testing.T) {
+	tagged := metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs(HeaderFault, "true"))
+	testCases := []struct {
+		name       string
+		rules      []Rule
+		ctx        context.Context
+		rand       float64
+		wantCode   codes.Code
+		wantCalled bool
+	}{
+		{
+			name:       "no rule",
+			ctx:        context.Background(),
+			wantCalled: true,
+		},
+		{
+			name:       "percent miss",
+			rules:      []Rule{{Pattern: "*", Percent: 10, Code: codes.Unavailable}},
+			ctx:        context.Background(),
+			rand:       0.5,
+			wantCalled: true,
+		},
+		{
+			name:       "error after call",
+			rules:      []Rule{{Pattern: "/user.v1.UserService/*", Percent: 100, Code: codes.Unavailable}},
+			ctx:        context.Background(),
+			wantCode:   codes.Unavailable,
+			wantCalled: true,
+		},
+		{
+			name:     "abort",
+			rules:    []Rule{{Pattern: "*", Percent: 100, Abort: true}},
+			ctx:      context.Background(),
+			wantCode: codes.Aborted,
+		},
+		{
+			name:       "untagged",
+			rules:      []Rule{{Pattern: "*", Percent: 100, Tagged: true, Abort: true}},
+			ctx:        context.Background(),
+			wantCalled: true,
+		},
+		{
+			name:     "tagged",
+			rules:    []Rule{{Pattern: "*", Percent: 100, Tagged: true, Abort: true}},
+			ctx:      tagged,
+			wantCode: codes.Aborted,
+		},
+		{
+			name:     "delay exceeds deadline",
+			rules:    []Rule{{Pattern: "*", Percent: 100, Delay: time.Second}},
+			ctx:      timeoutCtx(t, time.Millisecond*10),
+			wantCode: codes.DeadlineExceeded,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := NewInterceptorBuilder(logger.NewNoOpLogger(), tc.rules...)
+			b.rand = func() float64 {
+				return tc.rand
+			}
+			called := false
+			_, err := b.BuildServer()(tc.ctx, nil,
+				&grpc.UnaryServerInfo{FullMethod: "/user.v1.UserService/GetById"},
+				func(ctx context.Context, req any) (any, error) {
+					called = true
+					return "resp", nil
+				})
+			assert.Equal(t, tc.wantCode, status.Code(err))
+			assert.Equal(t, tc.wantCalled, called)
+		})
+	}
+}
+
+func TestInterceptorBuilder_SetRules(t *testing.T) {
+	b := NewInterceptorBuilder(logger.NewNoOpLogger(), Rule{Pattern: "*", Percent: 100, Abort: true})
+	interceptor := b.BuildClient()
+	invoker := func(ctx context.Context, method string, req, reply any,
+		cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		return nil
+	}
+	err := interceptor(context.Background(), "/user.v1.UserService/GetById", nil, nil, nil, invoker)
+	assert.Equal(t, codes.Aborted, status.Code(err))
+
+	// 运行期间关闭
+	b.SetRules()
+	err = interceptor(context.Background(), "/user.v1.UserService/GetById", nil, nil, nil, invoker)
+	assert.NoError(t, err)
+}
+
+func timeoutCtx(t *testing.T, timeout time.Duration) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	t.Cleanup(cancel)
+	return ctx
+}
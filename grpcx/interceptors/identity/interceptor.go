@@ -0,0 +1,95 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package identity
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/bgq98/utils/grpcx/interceptors"
+)
+
+type clientIPKey struct{}
+
+// WithClientIP 显式指定最初发起请求的 ip,例如不是从 gin 进来的请求
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// InterceptorBuilder 客户端拦截器,把本应用的名字和最初发起请求的 ip 放到 metadata 里面,
+// 服务端用 interceptors.Builder 的 PeerName 和 PeerIP 读取
+type InterceptorBuilder struct {
+	app string
+}
+
+// NewInterceptorBuilder app 是本应用的名字
+func NewInterceptorBuilder(app string) *InterceptorBuilder {
+	return &InterceptorBuilder{app: app}
+}
+
+func (b *InterceptorBuilder) BuildClient() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context,
+		method string, req, reply any,
+		cc *grpc.ClientConn, invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption) error {
+		return invoker(b.outgoing(ctx), method, req, reply, cc, opts...)
+	}
+}
+
+func (b *InterceptorBuilder) BuildStreamClient() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc,
+		cc *grpc.ClientConn, method string,
+		streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(b.outgoing(ctx), desc, cc, method, opts...)
+	}
+}
+
+// outgoing 已经设置过的不会覆盖
+func (b *InterceptorBuilder) outgoing(ctx context.Context) context.Context {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	if b.app != "" && len(md.Get(interceptors.HeaderApp)) == 0 {
+		md.Set(interceptors.HeaderApp, b.app)
+	}
+	if len(md.Get(interceptors.HeaderClientIP)) == 0 {
+		if ip := clientIP(ctx); ip != "" {
+			md.Set(interceptors.HeaderClientIP, ip)
+		}
+	}
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// clientIP 来源依次是 WithClientIP, *gin.Context, 上游 gRPC 请求传过来的 client-ip
+// 上游请求的对端地址是上游服务自己,不是最初发起请求的 ip,所以不用
+func clientIP(ctx context.Context) string {
+	if ip, ok := ctx.Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	// 前面的拦截器(例如 trace)可能已经把 *gin.Context 包了一层
+	if gc, ok := ctx.Value(gin.ContextKey).(*gin.Context); ok && gc.Request != nil {
+		return gc.ClientIP()
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if vals := md.Get(interceptors.HeaderClientIP); len(vals) > 0 {
+			return vals[0]
+		}
+	}
+	return ""
+}
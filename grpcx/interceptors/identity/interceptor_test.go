@@ -0,0 +1,98 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package identity
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestInterceptorBuilder_BuildClient(t *testing.T) {
+	testCases := []struct {
+		name   string
+		ctx    func() context.Context
+		wantIP []string
+	}{
+		{
+			name: "gin",
+			ctx: func() context.Context {
+				req, _ := http.NewRequest(http.MethodGet, "/", nil)
+				req.RemoteAddr = "[2001:db8::1]:12345"
+				gc, _ := gin.CreateTestContext(httptest.NewRecorder())
+				gc.Request = req
+				return gc
+			},
+			wantIP: []string{"2001:db8::1"},
+		},
+		{
+			name: "wrapped gin",
+			ctx: func() context.Context {
+				req, _ := http.NewRequest(http.MethodGet, "/", nil)
+				req.RemoteAddr = "10.0.0.3:12345"
+				gc, _ := gin.CreateTestContext(httptest.NewRecorder())
+				gc.Request = req
+				// 模拟 trace 拦截器在前面包了一层
+				type wrapKey struct{}
+				return context.WithValue(gc, wrapKey{}, "trace")
+			},
+			wantIP: []string{"10.0.0.3"},
+		},
+		{
+			name: "explicit",
+			ctx: func() context.Context {
+				return WithClientIP(context.Background(), "10.0.0.1")
+			},
+			wantIP: []string{"10.0.0.1"},
+		},
+		{
+			name: "forward",
+			ctx: func() context.Context {
+				return metadata.NewIncomingContext(context.Background(),
+					metadata.Pairs("client-ip", "10.0.0.2", "app", "bff"))
+			},
+			wantIP: []string{"10.0.0.2"},
+		},
+		{
+			name: "unknown",
+			ctx: func() context.Context {
+				return context.Background()
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			interceptor := NewInterceptorBuilder("user").BuildClient()
+			err := interceptor(tc.ctx(), "/user.v1.UserService/GetById", nil, nil, nil,
+				func(ctx context.Context, method string, req, reply any,
+					cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+					md, _ := metadata.FromOutgoingContext(ctx)
+					// app 是自己,不是上游
+					assert.Equal(t, []string{"user"}, md.Get("app"))
+					assert.Equal(t, tc.wantIP, md.Get("client-ip"))
+					return nil
+				})
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -18,101 +18,244 @@ package logging
 
 import (
 	"context"
-	"fmt"
-	"runtime"
+	"encoding/json"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
 
+	"github.com/bgq98/utils/grpcx/errs"
 	"github.com/bgq98/utils/grpcx/interceptors"
 	"github.com/bgq98/utils/logger"
 )
 
+// InterceptorBuilder 打印 RPC 日志
+// 成功用 Info,调用方的问题(参数错误等)用 Warn,服务端的问题用 Error
 type InterceptorBuilder struct {
 	l        logger.Logger
 	reqBody  bool
 	respBody bool
+	// maxBodySize 请求和响应最多打印多少个字节
+	maxBodySize int
+	// redact 这些字段的值不会打印出来,例如 password, phone
+	redact map[string]struct{}
 	interceptors.Builder
 }
 
-func (s *InterceptorBuilder) BuildCliet() grpc.UnaryClientInterceptor {
+func NewInterceptorBuilder(l logger.Logger) *InterceptorBuilder {
+	return &InterceptorBuilder{
+		l:           l,
+		maxBodySize: 1024,
+		redact:      map[string]struct{}{},
+	}
+}
+
+// ReqBody 打印请求,请求会被序列化成 JSON,很消耗 CPU,慎用
+func (s *InterceptorBuilder) ReqBody(ok bool) *InterceptorBuilder {
+	s.reqBody = ok
+	return s
+}
+
+// RespBody 打印响应,和 ReqBody 一样慎用
+func (s *InterceptorBuilder) RespBody(ok bool) *InterceptorBuilder {
+	s.respBody = ok
+	return s
+}
+
+func (s *InterceptorBuilder) MaxBodySize(size int) *InterceptorBuilder {
+	s.maxBodySize = size
+	return s
+}
+
+// Redact 不打印这些字段的值,字段名用 JSON 里面的名字,任意层级的同名字段都会被隐藏
+func (s *InterceptorBuilder) Redact(fields ...string) *InterceptorBuilder {
+	for _, f := range fields {
+		s.redact[f] = struct{}{}
+	}
+	return s
+}
+
+func (s *InterceptorBuilder) BuildClient() grpc.UnaryClientInterceptor {
 	return func(ctx context.Context,
 		method string, req, reply any,
 		cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) (err error) {
 		start := time.Now()
-		var event = "normal"
 		defer func() {
 			duration := time.Since(start)
-			if rec := recover(); rec != nil {
-				switch recType := rec.(type) {
-				case error:
-					err = recType
-				default:
-					err = fmt.Errorf("%v", rec)
-				}
-				stack := make([]byte, 4096)
-				stack = stack[:runtime.Stack(stack, true)]
-				event = "recover"
-				err = status.New(codes.Internal, "panic,err"+err.Error()).Err()
-			}
 			fields := []logger.Field{
 				logger.Int64("cost", duration.Milliseconds()),
 				logger.String("type", "unary"),
-				logger.String("event", event),
-				logger.String("peer", s.PeerName(ctx)),
-				logger.String("peer_ip", s.PeerIP(ctx)),
+				logger.String("method", method),
+				logger.String("target", cc.Target()),
 			}
-			if err != nil {
-				st, _ := status.FromError(err)
-				fields = append(fields,
-					logger.String("code", st.Code().String()),
-					logger.String("code_msg", st.Message()))
-			}
-			s.l.Info("RPC请求", fields...)
+			fields = s.bodyFields(fields, req, reply, err)
+			s.log(err, fields)
 		}()
 		return invoker(ctx, method, req, reply, cc, opts...)
 	}
 }
 
+// BuildCliet 拼写错误
+// Deprecated: 使用 BuildClient
+func (s *InterceptorBuilder) BuildCliet() grpc.UnaryClientInterceptor {
+	return s.BuildClient()
+}
+
 func (s *InterceptorBuilder) BuildServer() grpc.UnaryServerInterceptor {
 	return func(ctx context.Context,
 		req any, info *grpc.UnaryServerInfo,
 		handler grpc.UnaryHandler) (resp any, err error) {
 		start := time.Now()
-		var event = "normal"
 		defer func() {
 			duration := time.Since(start)
-			if rec := recover(); rec != nil {
-				switch recType := rec.(type) {
-				case error:
-					err = recType
-				default:
-					err = fmt.Errorf("%v", rec)
-				}
-				stack := make([]byte, 4096)
-				stack = stack[:runtime.Stack(stack, true)]
-				event = "recover"
-				err = status.New(codes.Internal, "panic,err"+err.Error()).Err()
-			}
 			fields := []logger.Field{
 				logger.Int64("cost", duration.Milliseconds()),
 				logger.String("type", "unary"),
 				logger.String("method", info.FullMethod),
-				logger.String("event", event),
 				logger.String("peer", s.PeerName(ctx)),
 				logger.String("peer_ip", s.PeerIP(ctx)),
 			}
-			if err != nil {
-				st, _ := status.FromError(err)
-				fields = append(fields,
-					logger.String("code", st.Code().String()),
-					logger.String("code_msg", st.Message()))
-			}
-			s.l.Info("RPC请求", fields...)
+			fields = s.bodyFields(fields, req, resp, err)
+			s.log(err, fields)
 		}()
 		resp, err = handler(ctx, req)
 		return
 	}
 }
+
+func (s *InterceptorBuilder) BuildStreamServer() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream,
+		info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		start := time.Now()
+		ctx := ss.Context()
+		stream := interceptors.NewServerStream(ss)
+		defer func() {
+			duration := time.Since(start)
+			fields := []logger.Field{
+				logger.Int64("cost", duration.Milliseconds()),
+				logger.String("type", "stream"),
+				logger.String("method", info.FullMethod),
+				logger.String("peer", s.PeerName(ctx)),
+				logger.String("peer_ip", s.PeerIP(ctx)),
+				logger.Int64("sent", stream.Sent()),
+				logger.Int64("received", stream.Received()),
+			}
+			s.log(err, fields)
+		}()
+		return handler(srv, stream)
+	}
+}
+
+// BuildStreamClient 流结束的时候才打印日志
+func (s *InterceptorBuilder) BuildStreamClient() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc,
+		cc *grpc.ClientConn, method string,
+		streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		start := time.Now()
+		// ctx 被取消的时候 logStream 会在另外一个 goroutine 里面调用
+		var stream atomic.Pointer[interceptors.ClientStream]
+		logStream := func(err error) {
+			fields := []logger.Field{
+				logger.Int64("cost", time.Since(start).Milliseconds()),
+				logger.String("type", "stream"),
+				logger.String("method", method),
+				logger.String("target", cc.Target()),
+			}
+			if cs := stream.Load(); cs != nil {
+				fields = append(fields,
+					logger.Int64("sent", cs.Sent()),
+					logger.Int64("received", cs.Received()))
+			}
+			s.log(err, fields)
+		}
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			logStream(err)
+			return nil, err
+		}
+		res := interceptors.NewClientStream(ctx, cs, desc, logStream)
+		stream.Store(res)
+		return res, nil
+	}
+}
+
+// log 按照错误的归类决定日志级别
+func (s *InterceptorBuilder) log(err error, fields []logger.Field) {
+	if err != nil {
+		st, _ := status.FromError(err)
+		fields = append(fields,
+			logger.String("code", st.Code().String()),
+			logger.String("code_msg", st.Message()))
+	}
+	switch errs.Classify(err) {
+	case errs.ClassOK:
+		s.l.Info("RPC请求", fields...)
+	case errs.ClassClient:
+		s.l.Warn("RPC请求", fields...)
+	default:
+		s.l.Error("RPC请求", fields...)
+	}
+}
+
+func (s *InterceptorBuilder) bodyFields(fields []logger.Field, req, resp any, err error) []logger.Field {
+	if s.reqBody {
+		fields = append(fields, logger.String("req", s.body(req)))
+	}
+	if s.respBody && err == nil {
+		fields = append(fields, logger.String("resp", s.body(resp)))
+	}
+	return fields
+}
+
+// body 把消息序列化成 JSON,隐藏敏感字段,超过长度的部分截断
+func (s *InterceptorBuilder) body(msg any) string {
+	var data []byte
+	var err error
+	if pm, ok := msg.(proto.Message); ok {
+		data, err = protojson.Marshal(pm)
+	} else {
+		data, err = json.Marshal(msg)
+	}
+	if err != nil {
+		return "序列化失败: " + err.Error()
+	}
+	if len(s.redact) > 0 {
+		var val any
+		if json.Unmarshal(data, &val) == nil {
+			s.redactValue(val)
+			if redacted, err := json.Marshal(val); err == nil {
+				data = redacted
+			}
+		}
+	}
+	if s.maxBodySize > 0 && len(data) > s.maxBodySize {
+		// 不要把一个字符从中间切开,不然日志里面是乱码
+		n := s.maxBodySize
+		for n > 0 && !utf8.RuneStart(data[n]) {
+			n--
+		}
+		return string(data[:n]) + "...(truncated)"
+	}
+	return string(data)
+}
+
+func (s *InterceptorBuilder) redactValue(val any) {
+	switch v := val.(type) {
+	case map[string]any:
+		for k, item := range v {
+			if _, ok := s.redact[k]; ok {
+				v[k] = "***"
+				continue
+			}
+			s.redactValue(item)
+		}
+	case []any:
+		for _, item := range v {
+			s.redactValue(item)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package logging
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/bgq98/utils/logger"
+)
+
+type levelLogger struct {
+	logger.NoOpLogger
+	level  string
+	fields map[string]any
+}
+
+func (l *levelLogger) record(level string, args []logger.Field) {
+	l.level = level
+	l.fields = make(map[string]any, len(args))
+	for _, arg := range args {
+		l.fields[arg.Key] = arg.Value
+	}
+}
+
+func (l *levelLogger) Info(msg string, args ...logger.Field) {
+	l.record("info", args)
+}
+
+func (l *levelLogger) Warn(msg string, args ...logger.Field) {
+	l.record("warn", args)
+}
+
+func (l *levelLogger) Error(msg string, args ...logger.Field) {
+	l.record("error", args)
+}
+
+func TestInterceptorBuilder_BuildServer(t *testing.T) {
+	testCases := []struct {
+		name      string
+		err       error
+		wantLevel string
+	}{
+		{
+			name:      "成功",
+			wantLevel: "info",
+		},
+		{
+			name:      "参数错误",
+			err:       status.Error(codes.InvalidArgument, "id 不对"),
+			wantLevel: "warn",
+		},
+		{
+			name:      "服务端错误",
+			err:       status.Error(codes.Internal, "数据库错误"),
+			wantLevel: "error",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := &levelLogger{}
+			interceptor := NewInterceptorBuilder(l).BuildServer()
+			_, _ = interceptor(context.Background(), nil,
+				&grpc.UnaryServerInfo{FullMethod: "/user.v1.UserService/GetById"},
+				func(ctx context.Context, req any) (any, error) {
+					return nil, tc.err
+				})
+			assert.Equal(t, tc.wantLevel, l.level)
+			assert.Equal(t, "/user.v1.UserService/GetById", l.fields["method"])
+		})
+	}
+}
+
+func TestInterceptorBuilder_body(t *testing.T) {
+	msg, err := structpb.NewStruct(map[string]any{
+		"name": "Tom",
+		"user": map[string]any{
+			"password": "123456",
+		},
+	})
+	assert.NoError(t, err)
+
+	b := NewInterceptorBuilder(logger.NewNoOpLogger()).Redact("password")
+	assert.JSONEq(t, `{"name":"Tom","user":{"password":"***"}}`, b.body(msg))
+
+	b = NewInterceptorBuilder(logger.NewNoOpLogger()).MaxBodySize(5)
+	assert.Equal(t, `{"nam...(truncated)`, b.body(msg))
+
+	// 姆 是 3 个字节,第 13 个字节在它中间,退回到它前面
+	b = NewInterceptorBuilder(logger.NewNoOpLogger()).MaxBodySize(13)
+	assert.Equal(t, `{"name":"汤...(truncated)`, b.body(map[string]string{"name": "汤姆"}))
+}
@@ -0,0 +1,34 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package interceptors
+
+import "strings"
+
+// MatchMethod 判断 fullMethod 是否匹配 pattern
+// pattern 支持三种写法:
+// 1. * 匹配所有方法
+// 2. /user.v1.UserService/* 匹配这个服务的所有方法,也就是前缀匹配
+// 3. /user.v1.UserService/GetById 精确匹配
+func MatchMethod(pattern, fullMethod string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(fullMethod, prefix)
+	}
+	return pattern == fullMethod
+}
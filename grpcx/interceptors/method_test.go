@@ -0,0 +1,44 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package interceptors
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchMethod(t *testing.T) {
+	testCases := []struct {
+		name    string
+		pattern string
+		method  string
+		want    bool
+	}{
+		{name: "all", pattern: "*", method: "/user.v1.UserService/GetById", want: true},
+		{name: "service", pattern: "/user.v1.UserService/*", method: "/user.v1.UserService/GetById", want: true},
+		{name: "other service", pattern: "/user.v1.UserService/*", method: "/user.v1.UserServiceX/GetById", want: false},
+		{name: "exact", pattern: "/user.v1.UserService/GetById", method: "/user.v1.UserService/GetById", want: true},
+		{name: "exact mismatch", pattern: "/user.v1.UserService/GetById", method: "/user.v1.UserService/Get", want: false},
+		{name: "empty", pattern: "", method: "/user.v1.UserService/GetById", want: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, MatchMethod(tc.pattern, tc.method))
+		})
+	}
+}
@@ -0,0 +1,226 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package mirror 流量镜像,把线上的部分请求复制一份发给新版本的服务,
+// 影子服务的响应会被丢弃,不会影响用户
+package mirror
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/bgq98/utils/grpcx"
+	"github.com/bgq98/utils/grpcx/interceptors"
+	"github.com/bgq98/utils/internal/metrics"
+	"github.com/bgq98/utils/logger"
+)
+
+// HeaderShadow 发给影子服务的请求会带上这个 metadata,
+// 影子服务可以据此把数据写到影子库,或者跳过发消息之类的副作用
+const HeaderShadow = "x-shadow"
+
+// NewShadowConn 通过 etcd 连接影子服务,name 和影子服务的 grpcx.Server.Name 一致
+func NewShadowConn(etcdClient *clientv3.Client, name string) (*grpc.ClientConn, error) {
+	return grpcx.NewClientBuilder(etcdClient, name).Build()
+}
+
+// InterceptorBuilder 客户端拦截器,主调用结束之后异步地把请求发给影子服务
+// 需要通过 Method 显式开启,写请求要确保影子服务不会产生真实的副作用
+type InterceptorBuilder struct {
+	l        logger.Logger
+	shadow   grpc.ClientConnInterface
+	patterns []string
+	ratio    float64
+	compare  bool
+	timeout  time.Duration
+	// sem 限制同时进行的影子请求,影子服务变慢的时候不会堆积大量 goroutine
+	sem  chan struct{}
+	wg   sync.WaitGroup
+	rand func() float64
+
+	registerer prometheus.Registerer
+	once       sync.Once
+	// requestCounter result 的取值:
+	// 不对比的时候是 ok 和 error,对比的时候是 match 和 mismatch,
+	// 影子请求太多被丢弃是 dropped
+	requestCounter *prometheus.CounterVec
+}
+
+// NewInterceptorBuilder shadow 是影子服务的连接,可以用 NewShadowConn 创建
+// 默认镜像 1% 的请求,不对比响应,影子请求超时时间 1s,最多同时 100 个影子请求
+func NewInterceptorBuilder(l logger.Logger, shadow grpc.ClientConnInterface) *InterceptorBuilder {
+	return &InterceptorBuilder{
+		l:       l,
+		shadow:  shadow,
+		ratio:   0.01,
+		timeout: time.Second,
+		sem:     make(chan struct{}, 100),
+		rand:    rand.Float64,
+	}
+}
+
+// Method 开启镜像的方法,支持 * 和前缀匹配,见 interceptors.MatchMethod
+func (s *InterceptorBuilder) Method(patterns ...string) *InterceptorBuilder {
+	s.patterns = append(s.patterns, patterns...)
+	return s
+}
+
+// Ratio 镜像的比例,0-1
+func (s *InterceptorBuilder) Ratio(ratio float64) *InterceptorBuilder {
+	s.ratio = ratio
+	return s
+}
+
+// Compare 对比影子服务和主服务的响应,不一致的时候打印日志并且记录到监控
+func (s *InterceptorBuilder) Compare(ok bool) *InterceptorBuilder {
+	s.compare = ok
+	return s
+}
+
+func (s *InterceptorBuilder) Timeout(timeout time.Duration) *InterceptorBuilder {
+	s.timeout = timeout
+	return s
+}
+
+// MaxConcurrency 同时进行的影子请求数,默认 100,小于等于 0 的时候忽略
+func (s *InterceptorBuilder) MaxConcurrency(n int) *InterceptorBuilder {
+	if n > 0 {
+		s.sem = make(chan struct{}, n)
+	}
+	return s
+}
+
+// Wait 等待正在进行的影子请求结束,关闭影子连接之前调用
+func (s *InterceptorBuilder) Wait() {
+	s.wg.Wait()
+}
+
+// Registerer 不设置就注册到 prometheus.DefaultRegisterer
+func (s *InterceptorBuilder) Registerer(r prometheus.Registerer) *InterceptorBuilder {
+	s.registerer = r
+	return s
+}
+
+// initMetrics 用到的时候才注册,只 import 不会注册指标
+func (s *InterceptorBuilder) initMetrics() {
+	s.once.Do(func() {
+		s.requestCounter = metrics.Register(s.registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpcx_mirror_requests_total",
+			Help: "流量镜像的请求数",
+		}, []string{"method", "result"}))
+	})
+}
+
+func (s *InterceptorBuilder) BuildClient() grpc.UnaryClientInterceptor {
+	s.initMetrics()
+	return func(ctx context.Context,
+		method string, req, reply any,
+		cc *grpc.ClientConn, invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption) error {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if s.enabled(method) && s.rand() < s.ratio {
+			s.mirror(ctx, method, req, reply, err)
+		}
+		return err
+	}
+}
+
+func (s *InterceptorBuilder) enabled(method string) bool {
+	for _, pattern := range s.patterns {
+		if interceptors.MatchMethod(pattern, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *InterceptorBuilder) mirror(ctx context.Context, method string, req, reply any, primaryErr error) {
+	reqMsg, ok := req.(proto.Message)
+	if !ok {
+		return
+	}
+	replyMsg, ok := reply.(proto.Message)
+	if !ok {
+		return
+	}
+	select {
+	case s.sem <- struct{}{}:
+	default:
+		s.requestCounter.WithLabelValues(method, "dropped").Inc()
+		return
+	}
+	// 主调用返回之后业务可能会修改请求和响应,所以要复制一份
+	reqMsg = proto.Clone(reqMsg)
+	var primary proto.Message
+	if s.compare && primaryErr == nil {
+		primary = proto.Clone(replyMsg)
+	}
+	shadowReply := replyMsg.ProtoReflect().New().Interface()
+
+	// 不能用主调用的 ctx,它很快就会被取消,只带上 metadata
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	md.Set(HeaderShadow, "true")
+
+	s.wg.Add(1)
+	go func() {
+		defer func() {
+			<-s.sem
+			s.wg.Done()
+		}()
+		shadowCtx, cancel := context.WithTimeout(metadata.NewOutgoingContext(context.Background(), md), s.timeout)
+		defer cancel()
+		shadowErr := s.shadow.Invoke(shadowCtx, method, reqMsg, shadowReply)
+		s.report(method, primary, primaryErr, shadowReply, shadowErr)
+	}()
+}
+
+func (s *InterceptorBuilder) report(method string,
+	primary proto.Message, primaryErr error,
+	shadow proto.Message, shadowErr error) {
+	if !s.compare {
+		result := "ok"
+		if shadowErr != nil {
+			result = "error"
+			s.l.Debug("影子请求失败", logger.String("method", method), logger.Error(shadowErr))
+		}
+		s.requestCounter.WithLabelValues(method, result).Inc()
+		return
+	}
+	primaryCode, shadowCode := status.Code(primaryErr), status.Code(shadowErr)
+	match := primaryCode == shadowCode
+	if match && primaryErr == nil {
+		match = proto.Equal(primary, shadow)
+	}
+	if match {
+		s.requestCounter.WithLabelValues(method, "match").Inc()
+		return
+	}
+	s.requestCounter.WithLabelValues(method, "mismatch").Inc()
+	s.l.Warn("影子服务的响应和主服务不一致",
+		logger.String("method", method),
+		logger.String("primary_code", primaryCode.String()),
+		logger.String("shadow_code", shadowCode.String()))
+}
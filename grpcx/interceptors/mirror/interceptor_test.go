@@ -0,0 +1,166 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package mirror
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/bgq98/utils/logger"
+)
+
+type shadowConn struct {
+	grpc.ClientConnInterface
+	calls  atomic.Int32
+	shadow bool
+	invoke func(reply any) error
+}
+
+func (c *shadowConn) Invoke(ctx context.Context, method string,
+	args any, reply any, opts ...grpc.CallOption) error {
+	c.calls.Add(1)
+	md, _ := metadata.FromOutgoingContext(ctx)
+	c.shadow = len(md.Get(HeaderShadow)) > 0
+	return c.invoke(reply)
+}
+
+type mismatchLogger struct {
+	logger.NoOpLogger
+	mismatches atomic.Int32
+}
+
+func (l *mismatchLogger) Warn(msg string, args ...logger.Field) {
+	l.mismatches.Add(1)
+}
+
+func TestInterceptorBuilder_BuildClient(t *testing.T) {
+	testCases := []struct {
+		name           string
+		method         string
+		rand           float64
+		shadow         func(reply any) error
+		wantCalls      int32
+		wantMismatches int32
+	}{
+		{
+			name:   "match",
+			method: "/user.v1.UserService/GetById",
+			shadow: func(reply any) error {
+				proto.Merge(reply.(proto.Message), wrapperspb.String("Tom"))
+				return nil
+			},
+			wantCalls: 1,
+		},
+		{
+			name:   "mismatch",
+			method: "/user.v1.UserService/GetById",
+			shadow: func(reply any) error {
+				proto.Merge(reply.(proto.Message), wrapperspb.String("Jerry"))
+				return nil
+			},
+			wantCalls:      1,
+			wantMismatches: 1,
+		},
+		{
+			name:   "shadow error",
+			method: "/user.v1.UserService/GetById",
+			shadow: func(reply any) error {
+				return status.Error(codes.Internal, "影子服务出错")
+			},
+			wantCalls:      1,
+			wantMismatches: 1,
+		},
+		{
+			name:   "not sampled",
+			method: "/user.v1.UserService/GetById",
+			rand:   0.9,
+		},
+		{
+			name:   "not enabled",
+			method: "/user.v1.UserService/Edit",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			shadow := &shadowConn{invoke: tc.shadow}
+			l := &mismatchLogger{}
+			b := NewInterceptorBuilder(l, shadow).
+				Method("/user.v1.UserService/GetById").
+				Ratio(0.5).
+				Compare(true)
+			b.rand = func() float64 {
+				return tc.rand
+			}
+			reply := &wrapperspb.StringValue{}
+			err := b.BuildClient()(context.Background(), tc.method, wrapperspb.Int64(123), reply, nil,
+				func(ctx context.Context, method string, req, reply any,
+					cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+					proto.Merge(reply.(proto.Message), wrapperspb.String("Tom"))
+					return nil
+				})
+			b.Wait()
+			assert.NoError(t, err)
+			// 影子服务的响应不会影响主调用
+			assert.Equal(t, "Tom", reply.GetValue())
+			assert.Equal(t, tc.wantCalls, shadow.calls.Load())
+			assert.Equal(t, tc.wantMismatches, l.mismatches.Load())
+			if tc.wantCalls > 0 {
+				assert.True(t, shadow.shadow)
+			}
+		})
+	}
+}
+
+func TestInterceptorBuilder_MaxConcurrency(t *testing.T) {
+	testCases := []struct {
+		name string
+		n    int
+		want int
+	}{
+		{
+			name: "set",
+			n:    5,
+			want: 5,
+		},
+		{
+			// 不然 sem 没有缓冲,所有的影子请求都会被丢掉
+			name: "zero",
+			n:    0,
+			want: 100,
+		},
+		{
+			name: "negative",
+			n:    -1,
+			want: 100,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := NewInterceptorBuilder(&mismatchLogger{}, &shadowConn{}).MaxConcurrency(tc.n)
+			assert.Equal(t, tc.want, cap(b.sem))
+		})
+	}
+}
@@ -19,55 +19,270 @@ package promethues
 import (
 	"context"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/bgq98/utils/grpcx/interceptors"
+	"github.com/bgq98/utils/internal/metrics"
 )
 
+// InterceptorBuilder 耗时的单位是毫秒
+// 默认用 Summary 统计耗时,调用 Histogram 之后改用 Histogram,并且会带上 trace id 作为 exemplar
 type InterceptorBuilder struct {
 	Namespace string
 	Subsystem string
 	interceptors.Builder
+
+	registerer prometheus.Registerer
+	histogram  bool
+	buckets    []float64
+
+	// 所有的 Build 方法共用同一组指标,只注册一次
+	once           sync.Once
+	serverHandled  prometheus.ObserverVec
+	clientHandled  prometheus.ObserverVec
+	serverInflight *prometheus.GaugeVec
+	clientInflight *prometheus.GaugeVec
+	serverMsgs     *prometheus.CounterVec
+	clientMsgs     *prometheus.CounterVec
+	serverMsgBytes *prometheus.HistogramVec
+	clientMsgBytes *prometheus.HistogramVec
 }
 
-func (s *InterceptorBuilder) BuildServer() grpc.UnaryServerInterceptor {
-	summary := prometheus.NewSummaryVec(
-		prometheus.SummaryOpts{
+func NewInterceptorBuilder(namespace string, subsystem string) *InterceptorBuilder {
+	return &InterceptorBuilder{
+		Namespace: namespace,
+		Subsystem: subsystem,
+	}
+}
+
+// Registerer 不设置就注册到 prometheus.DefaultRegisterer
+func (s *InterceptorBuilder) Registerer(r prometheus.Registerer) *InterceptorBuilder {
+	s.registerer = r
+	return s
+}
+
+// Histogram 用 Histogram 代替 Summary 统计耗时,buckets 的单位是毫秒,不传就用默认的
+func (s *InterceptorBuilder) Histogram(buckets ...float64) *InterceptorBuilder {
+	s.histogram = true
+	s.buckets = buckets
+	return s
+}
+
+func (s *InterceptorBuilder) init() {
+	s.once.Do(func() {
+		if s.registerer == nil {
+			s.registerer = prometheus.DefaultRegisterer
+		}
+		s.serverHandled = s.handledVec("server_handle_seconds",
+			[]string{"type", "service", "method", "peer", "code"})
+		s.clientHandled = s.handledVec("client_handle_seconds",
+			[]string{"type", "service", "method", "code"})
+		s.serverInflight = metrics.Register(s.registerer, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: s.Namespace,
+			Subsystem: s.Subsystem,
+			Name:      "server_inflight",
+			Help:      "服务端正在处理的请求数",
+		}, []string{"service", "method"}))
+		s.clientInflight = metrics.Register(s.registerer, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: s.Namespace,
+			Subsystem: s.Subsystem,
+			Name:      "client_inflight",
+			Help:      "客户端已经发出还没有返回的请求数",
+		}, []string{"service", "method"}))
+		// direction 是 sent 或者 received
+		s.serverMsgs = metrics.Register(s.registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: s.Namespace,
+			Subsystem: s.Subsystem,
+			Name:      "server_stream_msgs_total",
+		}, []string{"service", "method", "direction"}))
+		s.clientMsgs = metrics.Register(s.registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
 			Namespace: s.Namespace,
 			Subsystem: s.Subsystem,
-			Name:      "server_handle_seconds",
-			Objectives: map[float64]float64{
-				0.5:   0.01,
-				0.9:   0.01,
-				0.95:  0.01,
-				0.99:  0.001,
-				0.999: 0.0001,
-			},
-		}, []string{"type", "service", "method", "peer", "code"})
-	prometheus.MustRegister(summary)
+			Name:      "client_stream_msgs_total",
+		}, []string{"service", "method", "direction"}))
+		// 消息大小,只统计 protobuf 消息
+		sizeBuckets := prometheus.ExponentialBuckets(64, 4, 8)
+		s.serverMsgBytes = metrics.Register(s.registerer, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: s.Namespace,
+			Subsystem: s.Subsystem,
+			Name:      "server_msg_bytes",
+			Help:      "服务端收发的消息大小",
+			Buckets:   sizeBuckets,
+		}, []string{"service", "method", "direction"}))
+		s.clientMsgBytes = metrics.Register(s.registerer, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: s.Namespace,
+			Subsystem: s.Subsystem,
+			Name:      "client_msg_bytes",
+			Help:      "客户端收发的消息大小",
+			Buckets:   sizeBuckets,
+		}, []string{"service", "method", "direction"}))
+	})
+}
+
+func (s *InterceptorBuilder) handledVec(name string, labels []string) prometheus.ObserverVec {
+	if s.histogram {
+		buckets := s.buckets
+		if len(buckets) == 0 {
+			buckets = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+		}
+		return metrics.Register(s.registerer, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: s.Namespace,
+			Subsystem: s.Subsystem,
+			Name:      name,
+			Buckets:   buckets,
+		}, labels))
+	}
+	return metrics.Register(s.registerer, prometheus.NewSummaryVec(prometheus.SummaryOpts{
+		Namespace: s.Namespace,
+		Subsystem: s.Subsystem,
+		Name:      name,
+		Objectives: map[float64]float64{
+			0.5:   0.01,
+			0.9:   0.01,
+			0.95:  0.01,
+			0.99:  0.001,
+			0.999: 0.0001,
+		},
+	}, labels))
+}
+
+func (s *InterceptorBuilder) BuildServer() grpc.UnaryServerInterceptor {
+	s.init()
 	return func(ctx context.Context,
 		req any, info *grpc.UnaryServerInfo,
 		handler grpc.UnaryHandler) (resp any, err error) {
 		start := time.Now()
+		c, m := s.splitMethodName(info.FullMethod)
+		inflight := s.serverInflight.WithLabelValues(c, m)
+		inflight.Inc()
+		s.observeSize(s.serverMsgBytes, c, m, "received", req)
 		defer func() {
-			c, m := s.splitMethodName(info.FullMethod)
-			duration := float64(time.Since(start).Milliseconds())
+			inflight.Dec()
 			if err == nil {
-				summary.WithLabelValues("unary", c, m, s.PeerName(ctx), "OK").Observe(duration)
-			} else {
-				st, _ := status.FromError(err)
-				summary.WithLabelValues("unary", c, m, s.PeerName(ctx), st.Code().String()).Observe(duration)
+				s.observeSize(s.serverMsgBytes, c, m, "sent", resp)
 			}
+			s.observe(ctx, s.serverHandled.WithLabelValues("unary", c, m, s.PeerName(ctx), s.code(err)), start)
 		}()
 		resp, err = handler(ctx, req)
 		return
 	}
 }
 
+func (s *InterceptorBuilder) BuildClient() grpc.UnaryClientInterceptor {
+	s.init()
+	return func(ctx context.Context,
+		method string, req, reply any,
+		cc *grpc.ClientConn, invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption) (err error) {
+		start := time.Now()
+		c, m := s.splitMethodName(method)
+		inflight := s.clientInflight.WithLabelValues(c, m)
+		inflight.Inc()
+		s.observeSize(s.clientMsgBytes, c, m, "sent", req)
+		defer func() {
+			inflight.Dec()
+			if err == nil {
+				s.observeSize(s.clientMsgBytes, c, m, "received", reply)
+			}
+			s.observe(ctx, s.clientHandled.WithLabelValues("unary", c, m, s.code(err)), start)
+		}()
+		err = invoker(ctx, method, req, reply, cc, opts...)
+		return
+	}
+}
+
+// BuildStreamServer 记录整个流的耗时和收发的消息数
+func (s *InterceptorBuilder) BuildStreamServer() grpc.StreamServerInterceptor {
+	s.init()
+	return func(srv any, ss grpc.ServerStream,
+		info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		start := time.Now()
+		c, m := s.splitMethodName(info.FullMethod)
+		inflight := s.serverInflight.WithLabelValues(c, m)
+		inflight.Inc()
+		stream := interceptors.NewServerStream(ss)
+		stream.OnSend = s.onMsg(s.serverMsgs, s.serverMsgBytes, c, m, "sent")
+		stream.OnRecv = s.onMsg(s.serverMsgs, s.serverMsgBytes, c, m, "received")
+		defer func() {
+			inflight.Dec()
+			s.observe(ss.Context(), s.serverHandled.WithLabelValues("stream", c, m, s.PeerName(ss.Context()), s.code(err)), start)
+		}()
+		err = handler(srv, stream)
+		return
+	}
+}
+
+// BuildStreamClient 流结束的时候记录耗时和状态码
+func (s *InterceptorBuilder) BuildStreamClient() grpc.StreamClientInterceptor {
+	s.init()
+	return func(ctx context.Context, desc *grpc.StreamDesc,
+		cc *grpc.ClientConn, method string,
+		streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		start := time.Now()
+		c, m := s.splitMethodName(method)
+		inflight := s.clientInflight.WithLabelValues(c, m)
+		inflight.Inc()
+		finish := func(err error) {
+			inflight.Dec()
+			s.observe(ctx, s.clientHandled.WithLabelValues("stream", c, m, s.code(err)), start)
+		}
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			finish(err)
+			return nil, err
+		}
+		stream := interceptors.NewClientStream(ctx, cs, desc, finish)
+		stream.OnSend = s.onMsg(s.clientMsgs, s.clientMsgBytes, c, m, "sent")
+		stream.OnRecv = s.onMsg(s.clientMsgs, s.clientMsgBytes, c, m, "received")
+		return stream, nil
+	}
+}
+
+func (s *InterceptorBuilder) onMsg(cnt *prometheus.CounterVec, size *prometheus.HistogramVec,
+	service, method, direction string) func(msg any, err error) {
+	return func(msg any, err error) {
+		if err != nil {
+			return
+		}
+		cnt.WithLabelValues(service, method, direction).Inc()
+		s.observeSize(size, service, method, direction, msg)
+	}
+}
+
+func (s *InterceptorBuilder) observeSize(size *prometheus.HistogramVec, service, method, direction string, msg any) {
+	if pm, ok := msg.(proto.Message); ok {
+		size.WithLabelValues(service, method, direction).Observe(float64(proto.Size(pm)))
+	}
+}
+
+// observe 用 Histogram 的时候,如果当前请求被采样了,就带上 trace id
+func (s *InterceptorBuilder) observe(ctx context.Context, o prometheus.Observer, start time.Time) {
+	duration := float64(time.Since(start).Milliseconds())
+	if eo, ok := o.(prometheus.ExemplarObserver); ok {
+		sc := trace.SpanContextFromContext(ctx)
+		if sc.IsSampled() {
+			eo.ObserveWithExemplar(duration, prometheus.Labels{"trace_id": sc.TraceID().String()})
+			return
+		}
+	}
+	o.Observe(duration)
+}
+
+func (s *InterceptorBuilder) code(err error) string {
+	if err == nil {
+		return "OK"
+	}
+	st, _ := status.FromError(err)
+	return st.Code().String()
+}
+
 func (s *InterceptorBuilder) splitMethodName(fullMethodName string) (string, string) {
 	fullMethodName = strings.TrimPrefix(fullMethodName, "/")
 	if i := strings.Index(fullMethodName, "/"); i >= 0 {
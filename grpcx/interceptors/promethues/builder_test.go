@@ -0,0 +1,95 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package promethues
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestInterceptorBuilder_BuildServer(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	// 同一组指标注册两次不能 panic
+	NewInterceptorBuilder("test", "grpc").Registerer(reg).Histogram().BuildServer()
+	interceptor := NewInterceptorBuilder("test", "grpc").Registerer(reg).Histogram().BuildServer()
+
+	traceId, err := trace.TraceIDFromHex("0102030405060708090a0b0c0d0e0f10")
+	require.NoError(t, err)
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceId,
+		SpanID:     trace.SpanID{1},
+		TraceFlags: trace.FlagsSampled,
+	}))
+	_, err = interceptor(ctx, wrapperspb.String("hello"),
+		&grpc.UnaryServerInfo{FullMethod: "/user.v1.UserService/GetById"},
+		func(ctx context.Context, req any) (any, error) {
+			return wrapperspb.String("world"), nil
+		})
+	require.NoError(t, err)
+
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	found := map[string]bool{}
+	for _, mf := range mfs {
+		found[mf.GetName()] = true
+		if mf.GetName() == "test_grpc_server_handle_seconds" {
+			var exemplar string
+			for _, b := range mf.GetMetric()[0].GetHistogram().GetBucket() {
+				if b.GetExemplar() != nil {
+					exemplar = b.GetExemplar().GetLabel()[0].GetValue()
+				}
+			}
+			assert.Equal(t, traceId.String(), exemplar)
+		}
+	}
+	assert.True(t, found["test_grpc_server_handle_seconds"])
+	assert.True(t, found["test_grpc_server_inflight"])
+	assert.True(t, found["test_grpc_server_msg_bytes"])
+}
+
+// TestInterceptorBuilder_BuildStreamClient 调用方取消了 ctx,没有读完流,也要减掉 inflight
+func TestInterceptorBuilder_BuildStreamClient(t *testing.T) {
+	b := NewInterceptorBuilder("test", "grpc").Registerer(prometheus.NewRegistry())
+	interceptor := b.BuildStreamClient()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cs, err := interceptor(ctx, &grpc.StreamDesc{ServerStreams: true}, nil,
+		"/user.v1.UserService/List",
+		func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+			method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			return nil, nil
+		})
+	require.NoError(t, err)
+	require.NotNil(t, cs)
+	inflight := b.clientInflight.WithLabelValues("user.v1.UserService", "List")
+	assert.Equal(t, float64(1), testutil.ToFloat64(inflight))
+
+	cancel()
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(inflight) == 0
+	}, time.Second, time.Millisecond*10)
+	assert.Equal(t, 1, testutil.CollectAndCount(b.clientHandled.(prometheus.Collector)))
+}
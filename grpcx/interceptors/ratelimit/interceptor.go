@@ -23,9 +23,12 @@ import (
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 
 	"github.com/bgq98/utils/ginx/middlewares/ratelimit"
+	"github.com/bgq98/utils/grpcx/degrade"
+	"github.com/bgq98/utils/grpcx/interceptors"
 	"github.com/bgq98/utils/logger"
 )
 
@@ -34,75 +37,210 @@ type InterceptorBuilder struct {
 	l       logger.Logger
 	key     string // 限流器key
 	name    string // 服务名
+	rules   []Rule
+}
+
+// NewInterceptorBuilder key 是限流器 key 的前缀,例如 limiter,name 是服务名,例如 user
+func NewInterceptorBuilder(limiter ratelimit.Limiter, l logger.Logger,
+	key string, name string) *InterceptorBuilder {
+	return &InterceptorBuilder{
+		limiter: limiter,
+		l:       l,
+		key:     key,
+		name:    name,
+	}
+}
+
+// Rule 一条限流规则
+type Rule struct {
+	// Pattern 匹配的方法,写法见 interceptors.MatchMethod
+	Pattern string
+	// Name 用在限流的 key 里面,不设置就用 Pattern
+	// 同一条规则匹配到的方法共用一个限流额度
+	Name string
+	// Limiter 不设置就用 InterceptorBuilder 的
+	Limiter ratelimit.Limiter
+	// Key 按照调用方来区分限流对象,不设置就不区分
+	Key KeyFunc
+}
+
+// KeyFunc 从请求里面提取限流对象,例如对端应用名,对端 ip
+type KeyFunc func(ctx context.Context) string
+
+// KeyByPeerName 按照对端应用名限流
+func KeyByPeerName() KeyFunc {
+	var b interceptors.Builder
+	return b.PeerName
+}
+
+// KeyByPeerIP 按照对端 ip 限流
+func KeyByPeerIP() KeyFunc {
+	var b interceptors.Builder
+	return b.PeerIP
+}
+
+// KeyByMetadata 按照请求里面的某个元数据限流,例如 uid, tenant
+func KeyByMetadata(key string) KeyFunc {
+	return func(ctx context.Context) string {
+		md, ok := metadata.FromIncomingContext(ctx)
+		if !ok {
+			return ""
+		}
+		return strings.Join(md.Get(key), ";")
+	}
+}
+
+// AddRule 添加限流规则,按照添加的顺序匹配,只有第一条匹配上的规则生效
+func (s *InterceptorBuilder) AddRule(rule Rule) *InterceptorBuilder {
+	s.rules = append(s.rules, rule)
+	return s
 }
 
 // BuildServerInterceptor 整个应用,集群的限流
-// key limiter:service:user
+// 匹配上 AddRule 添加的规则就按照规则限流,key 见 BuildServerInterceptorService,
+// 没有匹配上就整个应用共用一个额度,key limiter:service:user
 func (s *InterceptorBuilder) BuildServerInterceptor() grpc.UnaryServerInterceptor {
 	return func(ctx context.Context,
 		req any, info *grpc.UnaryServerInfo,
 		handler grpc.UnaryHandler) (resp any, err error) {
-		limited, err := s.limiter.Limit(ctx, fmt.Sprintf(s.key+":"+s.name))
-		if err != nil {
-			s.l.Error("判定限流出了问题", logger.Error(err))
-			return nil, status.Errorf(codes.ResourceExhausted, "触发限流")
-		}
-		if limited {
-			return nil, status.Errorf(codes.ResourceExhausted, "触发限流")
+		limiter, key := s.limiterAndKey(ctx, info.FullMethod)
+		if err = s.limit(ctx, limiter, key); err != nil {
+			return nil, err
 		}
 		return handler(ctx, req)
 	}
 }
 
 // BuildServerInterceptorIO 配合后续业务做限流处理
-// key limiter:service:user
+// 触发限流的时候不拒绝请求,而是设置降级信号,业务用 degrade.IsLimited 判断
+// key 和 BuildServerInterceptor 一样
 func (s *InterceptorBuilder) BuildServerInterceptorIO() grpc.UnaryServerInterceptor {
 	return func(ctx context.Context,
 		req any, info *grpc.UnaryServerInfo,
 		handler grpc.UnaryHandler) (resp any, err error) {
-		limited, err := s.limiter.Limit(ctx, fmt.Sprintf(s.key+":"+s.name))
+		limiter, key := s.limiterAndKey(ctx, info.FullMethod)
+		limited, err := limiter.Limit(ctx, key)
 		if err != nil || limited {
-			ctx = context.WithValue(ctx, "limited", "true")
+			ctx = degrade.With(ctx, degrade.LevelPartial, degrade.ReasonRateLimit)
 		}
 		return handler(ctx, req)
 	}
 }
 
-// BuildClientInterceptor 客户端限流
-// key limiter:service:user
+// BuildClientInterceptor 客户端限流,key 和 BuildServerInterceptor 一样
+// 注意规则的 KeyFunc 拿到的是客户端的 ctx,KeyByPeerName 这些从服务端 ctx 取值的就取不到
 func (s *InterceptorBuilder) BuildClientInterceptor() grpc.UnaryClientInterceptor {
 	return func(ctx context.Context,
 		method string, req, reply any,
 		cc *grpc.ClientConn, invoker grpc.UnaryInvoker,
 		opts ...grpc.CallOption) error {
-		limited, err := s.limiter.Limit(ctx, fmt.Sprintf(s.key+":"+s.name))
-		if err != nil {
-			s.l.Error("判定限流出了问题", logger.Error(err))
-			return status.Errorf(codes.ResourceExhausted, "触发限流")
-		}
-		if limited {
-			return status.Errorf(codes.ResourceExhausted, "触发限流")
+		limiter, key := s.limiterAndKey(ctx, method)
+		if err := s.limit(ctx, limiter, key); err != nil {
+			return err
 		}
 		return invoker(ctx, method, req, reply, cc, opts...)
 	}
 }
 
-// BuildServerInterceptorService 服务级别限流
-// key limiter:service:user:UserService user 里面的 UserService 限流
+// BuildServerInterceptorService 服务/方法级别限流,按照 AddRule 添加的规则来
+// key limiter:service:user:规则名[:调用方]
+// 例如规则 {Pattern: "/UserService/*", Name: "UserService"} 的 key 是 limiter:service:user:UserService
+// 没有匹配上任何规则的方法不限流
 func (s *InterceptorBuilder) BuildServerInterceptorService() grpc.UnaryServerInterceptor {
 	return func(ctx context.Context,
 		req any, info *grpc.UnaryServerInfo,
 		handler grpc.UnaryHandler) (resp any, err error) {
-		if strings.HasPrefix(info.FullMethod, "/UserService") {
-			limited, err := s.limiter.Limit(ctx, fmt.Sprintf(s.key+":"+s.name+":"+"UserService"))
-			if err != nil {
-				s.l.Error("判定限流出了问题", logger.Error(err))
-				return nil, status.Errorf(codes.ResourceExhausted, "触发限流")
-			}
-			if limited {
-				return nil, status.Errorf(codes.ResourceExhausted, "触发限流")
+		rule, ok := s.match(info.FullMethod)
+		if ok {
+			if err = s.limit(ctx, s.ruleLimiter(rule), s.ruleKey(ctx, rule)); err != nil {
+				return nil, err
 			}
 		}
 		return handler(ctx, req)
 	}
 }
+
+// BuildStreamServerInterceptor 流式接口的限流,在建立流的时候判定
+// key 和 BuildServerInterceptor 一样
+func (s *InterceptorBuilder) BuildStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream,
+		info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := ss.Context()
+		limiter, key := s.limiterAndKey(ctx, info.FullMethod)
+		if err := s.limit(ctx, limiter, key); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// BuildStreamClientInterceptor 客户端流式接口的限流,在建立流的时候判定
+// key 和 BuildClientInterceptor 一样
+func (s *InterceptorBuilder) BuildStreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc,
+		cc *grpc.ClientConn, method string,
+		streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		limiter, key := s.limiterAndKey(ctx, method)
+		if err := s.limit(ctx, limiter, key); err != nil {
+			return nil, err
+		}
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+}
+
+// limit 触发限流或者限流器出错都返回 ResourceExhausted
+func (s *InterceptorBuilder) limit(ctx context.Context, limiter ratelimit.Limiter, key string) error {
+	limited, err := limiter.Limit(ctx, key)
+	if err != nil {
+		s.l.Error("判定限流出了问题", logger.Error(err), logger.String("key", key))
+		return status.Errorf(codes.ResourceExhausted, "触发限流")
+	}
+	if limited {
+		return status.Errorf(codes.ResourceExhausted, "触发限流")
+	}
+	return nil
+}
+
+func (s *InterceptorBuilder) appKey() string {
+	return fmt.Sprintf("%s:%s", s.key, s.name)
+}
+
+// limiterAndKey 匹配上规则就用规则的,不然就是整个应用的
+func (s *InterceptorBuilder) limiterAndKey(ctx context.Context, fullMethod string) (ratelimit.Limiter, string) {
+	if rule, ok := s.match(fullMethod); ok {
+		return s.ruleLimiter(rule), s.ruleKey(ctx, rule)
+	}
+	return s.limiter, s.appKey()
+}
+
+func (s *InterceptorBuilder) match(fullMethod string) (Rule, bool) {
+	for _, rule := range s.rules {
+		if interceptors.MatchMethod(rule.Pattern, fullMethod) {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+func (s *InterceptorBuilder) ruleLimiter(rule Rule) ratelimit.Limiter {
+	if rule.Limiter != nil {
+		return rule.Limiter
+	}
+	return s.limiter
+}
+
+func (s *InterceptorBuilder) ruleKey(ctx context.Context, rule Rule) string {
+	name := rule.Name
+	if name == "" {
+		name = rule.Pattern
+	}
+	key := fmt.Sprintf("%s:%s:%s", s.key, s.name, name)
+	if rule.Key == nil {
+		return key
+	}
+	caller := rule.Key(ctx)
+	if caller == "" {
+		caller = "unknown"
+	}
+	return key + ":" + caller
+}
@@ -0,0 +1,230 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ratelimit
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/bgq98/utils/ginx/middlewares/ratelimit"
+	limitmocks "github.com/bgq98/utils/ginx/middlewares/ratelimit/mocks"
+	"github.com/bgq98/utils/grpcx/degrade"
+	"github.com/bgq98/utils/logger"
+)
+
+func TestInterceptorBuilder_BuildServerInterceptorService(t *testing.T) {
+	testCases := []struct {
+		name     string
+		method   string
+		ctx      context.Context
+		mock     func(ctrl *gomock.Controller) ratelimit.Limiter
+		wantCode codes.Code
+	}{
+		{
+			name:   "no rule",
+			method: "/order.v1.OrderService/Get",
+			ctx:    context.Background(),
+			mock: func(ctrl *gomock.Controller) ratelimit.Limiter {
+				return limitmocks.NewMockLimiter(ctrl)
+			},
+		},
+		{
+			name:   "service rule",
+			method: "/user.v1.UserService/GetById",
+			ctx:    context.Background(),
+			mock: func(ctrl *gomock.Controller) ratelimit.Limiter {
+				l := limitmocks.NewMockLimiter(ctrl)
+				l.EXPECT().Limit(gomock.Any(), "limiter:user:UserService").Return(false, nil)
+				return l
+			},
+		},
+		{
+			name:   "method rule by peer",
+			method: "/user.v1.UserService/Login",
+			ctx: metadata.NewIncomingContext(context.Background(),
+				metadata.Pairs("app", "bff")),
+			mock: func(ctrl *gomock.Controller) ratelimit.Limiter {
+				l := limitmocks.NewMockLimiter(ctrl)
+				l.EXPECT().Limit(gomock.Any(), "limiter:user:/user.v1.UserService/Login:bff").Return(true, nil)
+				return l
+			},
+			wantCode: codes.ResourceExhausted,
+		},
+		{
+			name:   "metadata missing",
+			method: "/user.v1.UserService/Login",
+			ctx:    context.Background(),
+			mock: func(ctrl *gomock.Controller) ratelimit.Limiter {
+				l := limitmocks.NewMockLimiter(ctrl)
+				l.EXPECT().Limit(gomock.Any(), "limiter:user:/user.v1.UserService/Login:unknown").Return(false, nil)
+				return l
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			interceptor := NewInterceptorBuilder(tc.mock(ctrl), logger.NewNoOpLogger(), "limiter", "user").
+				AddRule(Rule{Pattern: "/user.v1.UserService/Login", Key: KeyByPeerName()}).
+				AddRule(Rule{Pattern: "/user.v1.UserService/*", Name: "UserService"}).
+				BuildServerInterceptorService()
+			_, err := interceptor(tc.ctx, nil, &grpc.UnaryServerInfo{FullMethod: tc.method},
+				func(ctx context.Context, req any) (any, error) {
+					return nil, nil
+				})
+			assert.Equal(t, tc.wantCode, status.Code(err))
+		})
+	}
+}
+
+func TestInterceptorBuilder_BuildServerInterceptorIO(t *testing.T) {
+	testCases := []struct {
+		name        string
+		limited     bool
+		wantLimited bool
+	}{
+		{
+			name: "not limited",
+		},
+		{
+			name:        "limited",
+			limited:     true,
+			wantLimited: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			limiter := limitmocks.NewMockLimiter(ctrl)
+			limiter.EXPECT().Limit(gomock.Any(), "limiter:user").Return(tc.limited, nil)
+			interceptor := NewInterceptorBuilder(limiter, logger.NewNoOpLogger(), "limiter", "user").
+				BuildServerInterceptorIO()
+			_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{},
+				func(ctx context.Context, req any) (any, error) {
+					// 业务通过降级信号判断要不要返回兜底数据
+					assert.Equal(t, tc.wantLimited, degrade.IsLimited(ctx))
+					return nil, nil
+				})
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// TestInterceptorBuilder_Rules 匹配上规则就按照规则限流,没有匹配上就整个应用限流
+func TestInterceptorBuilder_Rules(t *testing.T) {
+	// call 用不同的拦截器发起一次调用
+	type call func(b *InterceptorBuilder, method string) error
+	calls := map[string]call{
+		"server": func(b *InterceptorBuilder, method string) error {
+			_, err := b.BuildServerInterceptor()(context.Background(), nil,
+				&grpc.UnaryServerInfo{FullMethod: method},
+				func(ctx context.Context, req any) (any, error) {
+					return nil, nil
+				})
+			return err
+		},
+		"client": func(b *InterceptorBuilder, method string) error {
+			return b.BuildClientInterceptor()(context.Background(), method, nil, nil, nil,
+				func(ctx context.Context, method string, req, reply any,
+					cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+					return nil
+				})
+		},
+		"stream server": func(b *InterceptorBuilder, method string) error {
+			return b.BuildStreamServerInterceptor()(nil, &serverStream{ctx: context.Background()},
+				&grpc.StreamServerInfo{FullMethod: method},
+				func(srv any, stream grpc.ServerStream) error {
+					return nil
+				})
+		},
+		"stream client": func(b *InterceptorBuilder, method string) error {
+			_, err := b.BuildStreamClientInterceptor()(context.Background(), &grpc.StreamDesc{}, nil, method,
+				func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+					method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+					return nil, nil
+				})
+			return err
+		},
+	}
+	testCases := []struct {
+		name     string
+		method   string
+		mock     func(ctrl *gomock.Controller) (ratelimit.Limiter, ratelimit.Limiter)
+		wantCode codes.Code
+	}{
+		{
+			name:   "no rule",
+			method: "/order.v1.OrderService/Get",
+			mock: func(ctrl *gomock.Controller) (ratelimit.Limiter, ratelimit.Limiter) {
+				l := limitmocks.NewMockLimiter(ctrl)
+				l.EXPECT().Limit(gomock.Any(), "limiter:user").Return(false, nil)
+				return l, limitmocks.NewMockLimiter(ctrl)
+			},
+		},
+		{
+			name:   "service rule",
+			method: "/user.v1.UserService/GetById",
+			mock: func(ctrl *gomock.Controller) (ratelimit.Limiter, ratelimit.Limiter) {
+				l := limitmocks.NewMockLimiter(ctrl)
+				l.EXPECT().Limit(gomock.Any(), "limiter:user:UserService").Return(true, nil)
+				return l, limitmocks.NewMockLimiter(ctrl)
+			},
+			wantCode: codes.ResourceExhausted,
+		},
+		{
+			name:   "rule limiter",
+			method: "/user.v1.UserService/Login",
+			mock: func(ctrl *gomock.Controller) (ratelimit.Limiter, ratelimit.Limiter) {
+				ruleLimiter := limitmocks.NewMockLimiter(ctrl)
+				ruleLimiter.EXPECT().Limit(gomock.Any(), "limiter:user:login").Return(true, nil)
+				return limitmocks.NewMockLimiter(ctrl), ruleLimiter
+			},
+			wantCode: codes.ResourceExhausted,
+		},
+	}
+	for name, c := range calls {
+		for _, tc := range testCases {
+			t.Run(name+"/"+tc.name, func(t *testing.T) {
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+				limiter, ruleLimiter := tc.mock(ctrl)
+				b := NewInterceptorBuilder(limiter, logger.NewNoOpLogger(), "limiter", "user").
+					AddRule(Rule{Pattern: "/user.v1.UserService/Login", Name: "login", Limiter: ruleLimiter}).
+					AddRule(Rule{Pattern: "/user.v1.UserService/*", Name: "UserService"})
+				assert.Equal(t, tc.wantCode, status.Code(c(b, tc.method)))
+			})
+		}
+	}
+}
+
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
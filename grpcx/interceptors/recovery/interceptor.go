@@ -0,0 +1,145 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package recovery
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bgq98/utils/internal/metrics"
+	"github.com/bgq98/utils/logger"
+)
+
+// HandlerFunc 把 panic 转成返回给调用方的错误
+type HandlerFunc func(ctx context.Context, method string, p any) error
+
+// InterceptorBuilder 捕获 panic,打印发生 panic 的 goroutine 的完整堆栈,
+// 记录监控,然后转成 codes.Internal 返回
+// 应该放在拦截器链的最里层,这样外层的日志,监控,trace 都能看到转换之后的错误
+type InterceptorBuilder struct {
+	l       logger.Logger
+	handler HandlerFunc
+
+	registerer   prometheus.Registerer
+	once         sync.Once
+	panicCounter *prometheus.CounterVec
+}
+
+func NewInterceptorBuilder(l logger.Logger) *InterceptorBuilder {
+	return &InterceptorBuilder{
+		l: l,
+		handler: func(ctx context.Context, method string, p any) error {
+			return status.Errorf(codes.Internal, "服务内部错误")
+		},
+	}
+}
+
+// Handler 自定义 panic 转成什么错误
+func (b *InterceptorBuilder) Handler(fn HandlerFunc) *InterceptorBuilder {
+	b.handler = fn
+	return b
+}
+
+// Registerer 不设置就注册到 prometheus.DefaultRegisterer
+func (b *InterceptorBuilder) Registerer(r prometheus.Registerer) *InterceptorBuilder {
+	b.registerer = r
+	return b
+}
+
+// initMetrics 用到的时候才注册,只 import 不会注册指标
+func (b *InterceptorBuilder) initMetrics() {
+	b.once.Do(func() {
+		b.panicCounter = metrics.Register(b.registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpcx_panics_total",
+			Help: "RPC 处理过程中 panic 的次数",
+		}, []string{"side", "method"}))
+	})
+}
+
+func (b *InterceptorBuilder) BuildServer() grpc.UnaryServerInterceptor {
+	b.initMetrics()
+	return func(ctx context.Context,
+		req any, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (resp any, err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				err = b.recovered(ctx, "server", info.FullMethod, p)
+			}
+		}()
+		return handler(ctx, req)
+	}
+}
+
+func (b *InterceptorBuilder) BuildStreamServer() grpc.StreamServerInterceptor {
+	b.initMetrics()
+	return func(srv any, ss grpc.ServerStream,
+		info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				err = b.recovered(ss.Context(), "server", info.FullMethod, p)
+			}
+		}()
+		return handler(srv, ss)
+	}
+}
+
+func (b *InterceptorBuilder) BuildClient() grpc.UnaryClientInterceptor {
+	b.initMetrics()
+	return func(ctx context.Context,
+		method string, req, reply any,
+		cc *grpc.ClientConn, invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption) (err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				err = b.recovered(ctx, "client", method, p)
+			}
+		}()
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+func (b *InterceptorBuilder) BuildStreamClient() grpc.StreamClientInterceptor {
+	b.initMetrics()
+	return func(ctx context.Context, desc *grpc.StreamDesc,
+		cc *grpc.ClientConn, method string,
+		streamer grpc.Streamer, opts ...grpc.CallOption) (cs grpc.ClientStream, err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				err = b.recovered(ctx, "client", method, p)
+			}
+		}()
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+}
+
+// recovered 在 defer 里面调用,debug.Stack 拿到的就是发生 panic 的 goroutine 的堆栈
+func (b *InterceptorBuilder) recovered(ctx context.Context, side, method string, p any) error {
+	b.panicCounter.WithLabelValues(side, method).Inc()
+	b.l.Error("RPC panic",
+		logger.String("side", side),
+		logger.String("method", method),
+		logger.String("panic", fmt.Sprintf("%v", p)),
+		logger.String("stack", string(debug.Stack())))
+	return b.handler(ctx, method, p)
+}
@@ -0,0 +1,99 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package recovery
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bgq98/utils/logger"
+)
+
+type stackLogger struct {
+	logger.NoOpLogger
+	stack string
+}
+
+func (l *stackLogger) Error(msg string, args ...logger.Field) {
+	for _, arg := range args {
+		if arg.Key == "stack" {
+			l.stack = arg.Value.(string)
+		}
+	}
+}
+
+func TestInterceptorBuilder_BuildServer(t *testing.T) {
+	l := &stackLogger{}
+	interceptor := NewInterceptorBuilder(l).BuildServer()
+	_, err := interceptor(context.Background(), nil,
+		&grpc.UnaryServerInfo{FullMethod: "/user.v1.UserService/GetById"},
+		func(ctx context.Context, req any) (any, error) {
+			panicInHandler()
+			return nil, nil
+		})
+	assert.Equal(t, codes.Internal, status.Code(err))
+	// 堆栈里面要有发生 panic 的函数
+	assert.True(t, strings.Contains(l.stack, "panicInHandler"), l.stack)
+}
+
+func TestInterceptorBuilder_Handler(t *testing.T) {
+	interceptor := NewInterceptorBuilder(logger.NewNoOpLogger()).
+		Handler(func(ctx context.Context, method string, p any) error {
+			return status.Errorf(codes.Unavailable, "%v", p)
+		}).
+		BuildServer()
+	_, err := interceptor(context.Background(), nil,
+		&grpc.UnaryServerInfo{FullMethod: "/user.v1.UserService/GetById"},
+		func(ctx context.Context, req any) (any, error) {
+			panic("boom")
+		})
+	assert.Equal(t, status.Error(codes.Unavailable, "boom").Error(), err.Error())
+}
+
+func panicInHandler() {
+	var m map[string]int
+	m["a"] = 1
+}
+
+func TestInterceptorBuilder_Registerer(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	b := NewInterceptorBuilder(logger.NewNoOpLogger()).Registerer(reg)
+	// 还没有 Build,不会注册
+	cnt, err := testutil.GatherAndCount(reg)
+	require.NoError(t, err)
+	assert.Equal(t, 0, cnt)
+
+	// 多个 InterceptorBuilder 注册到同一个 Registerer 不能 panic
+	NewInterceptorBuilder(logger.NewNoOpLogger()).Registerer(reg).BuildServer()
+	interceptor := b.BuildServer()
+	_, _ = interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/user.v1.UserService/GetById"},
+		func(ctx context.Context, req any) (any, error) {
+			panic("数据库连接是 nil")
+		})
+	cnt, err = testutil.GatherAndCount(reg, "grpcx_panics_total")
+	require.NoError(t, err)
+	assert.Equal(t, 1, cnt)
+}
@@ -0,0 +1,63 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package retry
+
+import "sync"
+
+// Budget 重试预算,避免下游出问题的时候重试把流量放大好几倍
+// 每个请求存入 ratio 个令牌,每次重试取出一个,令牌最多 max 个
+// 例如 ratio = 0.1 就是重试的请求最多占正常请求的 10%,另外允许 max 个突发
+// nil 代表不限制,重试的次数只受 MaxAttempts 限制
+type Budget struct {
+	lock   sync.Mutex
+	ratio  float64
+	max    float64
+	tokens float64
+}
+
+func NewBudget(ratio float64, max float64) *Budget {
+	return &Budget{
+		ratio:  ratio,
+		max:    max,
+		tokens: max,
+	}
+}
+
+func (b *Budget) deposit() {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens += b.ratio
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+}
+
+func (b *Budget) withdraw() bool {
+	if b == nil {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
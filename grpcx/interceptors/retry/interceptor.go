@@ -0,0 +1,267 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package retry
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/bgq98/utils/grpcx/backoff"
+	"github.com/bgq98/utils/grpcx/interceptors"
+	"github.com/bgq98/utils/internal/metrics"
+	"github.com/bgq98/utils/logger"
+)
+
+type safeKey struct{}
+
+// MarkSafe 标记这一次调用可以安全重试,用于没有在 Idempotent 里面声明的方法
+func MarkSafe(ctx context.Context) context.Context {
+	return context.WithValue(ctx, safeKey{}, true)
+}
+
+// InterceptorBuilder 客户端重试
+// 只有幂等的方法才会重试,默认只在 Unavailable 的时候重试
+type InterceptorBuilder struct {
+	l           logger.Logger
+	maxAttempts int
+	codes       map[codes.Code]struct{}
+	backoff     backoff.Exponential
+	idempotent  []string
+	hedgeDelay  time.Duration
+	budget      *Budget
+
+	registerer prometheus.Registerer
+	once       sync.Once
+	// attemptCounter kind 是 retry, hedge 或者 budget_exhausted
+	attemptCounter *prometheus.CounterVec
+}
+
+func NewInterceptorBuilder(l logger.Logger) *InterceptorBuilder {
+	return &InterceptorBuilder{
+		l:           l,
+		maxAttempts: 3,
+		codes: map[codes.Code]struct{}{
+			codes.Unavailable: {},
+		},
+		backoff: backoff.NewExponential(time.Millisecond*50, time.Second),
+		budget:  NewBudget(0.1, 10),
+	}
+}
+
+// MaxAttempts 最多调用几次,包括第一次
+func (b *InterceptorBuilder) MaxAttempts(n int) *InterceptorBuilder {
+	b.maxAttempts = n
+	return b
+}
+
+// RetryOn 哪些错误码需要重试,会覆盖默认的 Unavailable
+func (b *InterceptorBuilder) RetryOn(cs ...codes.Code) *InterceptorBuilder {
+	b.codes = make(map[codes.Code]struct{}, len(cs))
+	for _, c := range cs {
+		b.codes[c] = struct{}{}
+	}
+	return b
+}
+
+func (b *InterceptorBuilder) Backoff(bf backoff.Exponential) *InterceptorBuilder {
+	b.backoff = bf
+	return b
+}
+
+// Idempotent 声明幂等的方法,写法见 interceptors.MatchMethod
+func (b *InterceptorBuilder) Idempotent(patterns ...string) *InterceptorBuilder {
+	b.idempotent = append(b.idempotent, patterns...)
+	return b
+}
+
+// Hedge 第一次调用超过 delay 还没有返回,就再发一个请求,谁先成功用谁的
+// 响应必须是 proto.Message,0 代表不开启
+func (b *InterceptorBuilder) Hedge(delay time.Duration) *InterceptorBuilder {
+	b.hedgeDelay = delay
+	return b
+}
+
+// Budget 默认是 NewBudget(0.1, 10),nil 代表不限制
+func (b *InterceptorBuilder) Budget(budget *Budget) *InterceptorBuilder {
+	b.budget = budget
+	return b
+}
+
+// Registerer 不设置就注册到 prometheus.DefaultRegisterer
+func (b *InterceptorBuilder) Registerer(r prometheus.Registerer) *InterceptorBuilder {
+	b.registerer = r
+	return b
+}
+
+// initMetrics 用到的时候才注册,只 import 不会注册指标
+func (b *InterceptorBuilder) initMetrics() {
+	b.once.Do(func() {
+		b.attemptCounter = metrics.Register(b.registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpcx_client_retry_attempts_total",
+			Help: "客户端重试和对冲请求的次数",
+		}, []string{"method", "kind"}))
+	})
+}
+
+func (b *InterceptorBuilder) BuildClient() grpc.UnaryClientInterceptor {
+	b.initMetrics()
+	return func(ctx context.Context,
+		method string, req, reply any,
+		cc *grpc.ClientConn, invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption) error {
+		b.budget.deposit()
+		if b.maxAttempts <= 1 || !b.safe(ctx, method) {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		if msg, ok := reply.(proto.Message); ok && b.hedgeDelay > 0 {
+			return b.hedge(ctx, method, req, msg, cc, invoker, opts...)
+		}
+		return b.retry(ctx, method, req, reply, cc, invoker, opts...)
+	}
+}
+
+func (b *InterceptorBuilder) retry(ctx context.Context,
+	method string, req, reply any,
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption) error {
+	for attempt := 0; ; attempt++ {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if err == nil || !b.retryable(err) || attempt+1 >= b.maxAttempts {
+			return err
+		}
+		wait := b.backoff.Next(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= wait {
+			// 等不到下一次重试就超时了,没必要再试
+			return err
+		}
+		if !b.budget.withdraw() {
+			b.attemptCounter.WithLabelValues(method, "budget_exhausted").Inc()
+			return err
+		}
+		b.record(ctx, method, "retry", attempt+1, err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+func (b *InterceptorBuilder) hedge(ctx context.Context,
+	method string, req any, reply proto.Message,
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption) error {
+	// 返回的时候取消还没有结束的请求
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		reply proto.Message
+		err   error
+	}
+	results := make(chan result, b.maxAttempts)
+	launched := 0
+	launch := func() {
+		launched++
+		r := proto.Clone(reply)
+		proto.Reset(r)
+		go func() {
+			err := invoker(ctx, method, req, r, cc, opts...)
+			results <- result{reply: r, err: err}
+		}()
+	}
+	launch()
+	timer := time.NewTimer(b.hedgeDelay)
+	defer timer.Stop()
+
+	finished := 0
+	var lastErr error
+	for {
+		select {
+		case <-timer.C:
+			if launched < b.maxAttempts && b.budget.withdraw() {
+				b.record(ctx, method, "hedge", launched, nil)
+				launch()
+				timer.Reset(b.hedgeDelay)
+			}
+		case res := <-results:
+			finished++
+			if res.err == nil {
+				proto.Reset(reply)
+				proto.Merge(reply, res.reply)
+				return nil
+			}
+			if !b.retryable(res.err) {
+				return res.err
+			}
+			lastErr = res.err
+			if finished < launched {
+				// 还有别的请求没有返回,继续等
+				continue
+			}
+			if launched >= b.maxAttempts || !b.budget.withdraw() {
+				return lastErr
+			}
+			b.record(ctx, method, "retry", launched, lastErr)
+			launch()
+		}
+	}
+}
+
+func (b *InterceptorBuilder) safe(ctx context.Context, method string) bool {
+	if ok, _ := ctx.Value(safeKey{}).(bool); ok {
+		return true
+	}
+	for _, pattern := range b.idempotent {
+		if interceptors.MatchMethod(pattern, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *InterceptorBuilder) retryable(err error) bool {
+	_, ok := b.codes[status.Code(err)]
+	return ok
+}
+
+// record 记录到监控和当前的 span 上
+func (b *InterceptorBuilder) record(ctx context.Context, method, kind string, attempt int, err error) {
+	b.attemptCounter.WithLabelValues(method, kind).Inc()
+	attrs := []attribute.KeyValue{
+		attribute.Key("rpc.retry.kind").String(kind),
+		attribute.Key("rpc.retry.attempt").Int(attempt),
+	}
+	if err != nil {
+		attrs = append(attrs, attribute.Key("rpc.grpc.status_code").String(status.Code(err).String()))
+	}
+	trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(attrs...))
+	b.l.Debug("重试 RPC 请求",
+		logger.String("method", method),
+		logger.String("kind", kind),
+		logger.Int64("attempt", int64(attempt)))
+}
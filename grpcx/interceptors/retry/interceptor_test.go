@@ -0,0 +1,148 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package retry
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/bgq98/utils/grpcx/backoff"
+	"github.com/bgq98/utils/logger"
+)
+
+func TestInterceptorBuilder_Retry(t *testing.T) {
+	testCases := []struct {
+		name     string
+		ctx      context.Context
+		method   string
+		errs     []error
+		budget   *Budget
+		wantCode codes.Code
+		wantCnt  int32
+	}{
+		{
+			name:    "success after retry",
+			ctx:     context.Background(),
+			method:  "/user.v1.UserService/GetById",
+			errs:    []error{status.Error(codes.Unavailable, "down"), nil},
+			budget:  NewBudget(0.1, 10),
+			wantCnt: 2,
+		},
+		{
+			name:   "max attempts",
+			ctx:    context.Background(),
+			method: "/user.v1.UserService/GetById",
+			errs: []error{status.Error(codes.Unavailable, "down"),
+				status.Error(codes.Unavailable, "down"), status.Error(codes.Unavailable, "down")},
+			budget:   NewBudget(0.1, 10),
+			wantCode: codes.Unavailable,
+			wantCnt:  3,
+		},
+		{
+			name:     "not retryable code",
+			ctx:      context.Background(),
+			method:   "/user.v1.UserService/GetById",
+			errs:     []error{status.Error(codes.InvalidArgument, "bad")},
+			budget:   NewBudget(0.1, 10),
+			wantCode: codes.InvalidArgument,
+			wantCnt:  1,
+		},
+		{
+			name:     "not idempotent",
+			ctx:      context.Background(),
+			method:   "/user.v1.UserService/Create",
+			errs:     []error{status.Error(codes.Unavailable, "down")},
+			budget:   NewBudget(0.1, 10),
+			wantCode: codes.Unavailable,
+			wantCnt:  1,
+		},
+		{
+			name:    "marked safe",
+			ctx:     MarkSafe(context.Background()),
+			method:  "/user.v1.UserService/Create",
+			errs:    []error{status.Error(codes.Unavailable, "down"), nil},
+			budget:  NewBudget(0.1, 10),
+			wantCnt: 2,
+		},
+		{
+			name:     "budget exhausted",
+			ctx:      context.Background(),
+			method:   "/user.v1.UserService/GetById",
+			errs:     []error{status.Error(codes.Unavailable, "down")},
+			budget:   NewBudget(0.1, 0),
+			wantCode: codes.Unavailable,
+			wantCnt:  1,
+		},
+		{
+			name:   "no budget",
+			ctx:    context.Background(),
+			method: "/user.v1.UserService/GetById",
+			errs: []error{status.Error(codes.Unavailable, "down"),
+				status.Error(codes.Unavailable, "down"), nil},
+			wantCnt: 3,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var cnt atomic.Int32
+			interceptor := NewInterceptorBuilder(logger.NewNoOpLogger()).
+				Idempotent("/user.v1.UserService/Get*").
+				Backoff(backoff.Exponential{Initial: time.Millisecond, Max: time.Millisecond}).
+				Budget(tc.budget).
+				BuildClient()
+			err := interceptor(tc.ctx, tc.method, nil, nil, nil,
+				func(ctx context.Context, method string, req, reply any,
+					cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+					idx := cnt.Add(1) - 1
+					return tc.errs[idx]
+				})
+			assert.Equal(t, tc.wantCode, status.Code(err))
+			assert.Equal(t, tc.wantCnt, cnt.Load())
+		})
+	}
+}
+
+func TestInterceptorBuilder_Hedge(t *testing.T) {
+	var cnt atomic.Int32
+	interceptor := NewInterceptorBuilder(logger.NewNoOpLogger()).
+		Idempotent("*").
+		Hedge(time.Millisecond * 10).
+		BuildClient()
+	reply := &wrapperspb.StringValue{}
+	err := interceptor(context.Background(), "/user.v1.UserService/GetById", nil, reply, nil,
+		func(ctx context.Context, method string, req, reply any,
+			cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			if cnt.Add(1) == 1 {
+				// 第一个请求卡住,直到被取消
+				<-ctx.Done()
+				return status.FromContextError(ctx.Err()).Err()
+			}
+			reply.(*wrapperspb.StringValue).Value = "hedged"
+			return nil
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, "hedged", reply.Value)
+	assert.Equal(t, int32(2), cnt.Load())
+}
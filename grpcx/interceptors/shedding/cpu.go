@@ -0,0 +1,230 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package shedding
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	cgroupV2Stat    = "/sys/fs/cgroup/cpu.stat"
+	cgroupV2Max     = "/sys/fs/cgroup/cpu.max"
+	cgroupV1Usage   = "/sys/fs/cgroup/cpuacct/cpuacct.usage"
+	cgroupV1Quota   = "/sys/fs/cgroup/cpu/cpu.cfs_quota_us"
+	cgroupV1Period  = "/sys/fs/cgroup/cpu/cpu.cfs_period_us"
+	procStat        = "/proc/stat"
+	cpuDecay        = 0.8
+	defaultInterval = time.Millisecond * 500
+)
+
+// CPU 定期采样 CPU 使用率
+// 优先读 cgroup v2,其次 cgroup v1,这样在容器里面拿到的是容器配额的使用率,
+// 都读不到的时候读 /proc/stat,拿到的是整台机器的使用率
+type CPU struct {
+	// usage 千分比,做了指数平滑
+	usage atomic.Int64
+	// stat 返回累计的繁忙时间和总时间,单位无所谓,两者一致就可以
+	stat      func() (busy, total float64, err error)
+	prevBusy  float64
+	prevTotal float64
+	stop      chan struct{}
+	once      sync.Once
+}
+
+// NewCPU interval 是采样间隔,不设置默认 500ms
+// 用完之后要调用 Close
+func NewCPU(interval time.Duration) (*CPU, error) {
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	stat, err := cpuStat()
+	if err != nil {
+		return nil, err
+	}
+	c := &CPU{stat: stat, stop: make(chan struct{})}
+	c.prevBusy, c.prevTotal, err = stat()
+	if err != nil {
+		return nil, err
+	}
+	go c.loop(interval)
+	return c, nil
+}
+
+// Usage CPU 使用率的千分比,可以直接作为 Config.CPU
+func (c *CPU) Usage() int64 {
+	return c.usage.Load()
+}
+
+func (c *CPU) Close() {
+	c.once.Do(func() {
+		close(c.stop)
+	})
+}
+
+func (c *CPU) loop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.sample()
+		}
+	}
+}
+
+func (c *CPU) sample() {
+	busy, total, err := c.stat()
+	if err != nil {
+		return
+	}
+	dBusy, dTotal := busy-c.prevBusy, total-c.prevTotal
+	c.prevBusy, c.prevTotal = busy, total
+	if dTotal <= 0 || dBusy < 0 {
+		return
+	}
+	cur := dBusy / dTotal * 1000
+	if cur > 1000 {
+		cur = 1000
+	}
+	prev := float64(c.usage.Load())
+	c.usage.Store(int64(prev*cpuDecay + cur*(1-cpuDecay)))
+}
+
+// cpuStat 按照 cgroup v2, cgroup v1, /proc/stat 的顺序找能用的数据源
+func cpuStat() (func() (float64, float64, error), error) {
+	if _, err := os.Stat(cgroupV2Stat); err == nil {
+		cores := cgroupV2Cores()
+		return func() (float64, float64, error) {
+			data, err := os.ReadFile(cgroupV2Stat)
+			if err != nil {
+				return 0, 0, err
+			}
+			usage, err := parseCgroupV2Usage(string(data))
+			if err != nil {
+				return 0, 0, err
+			}
+			// 微秒
+			return usage, float64(time.Now().UnixMicro()) * cores, nil
+		}, nil
+	}
+	if _, err := os.Stat(cgroupV1Usage); err == nil {
+		cores := cgroupV1Cores()
+		return func() (float64, float64, error) {
+			usage, err := readInt(cgroupV1Usage)
+			if err != nil {
+				return 0, 0, err
+			}
+			// 纳秒
+			return float64(usage), float64(time.Now().UnixNano()) * cores, nil
+		}, nil
+	}
+	if _, err := os.Stat(procStat); err == nil {
+		return func() (float64, float64, error) {
+			data, err := os.ReadFile(procStat)
+			if err != nil {
+				return 0, 0, err
+			}
+			return parseProcStat(string(data))
+		}, nil
+	}
+	return nil, errors.New("shedding: 找不到 CPU 使用率的数据源")
+}
+
+func cgroupV2Cores() float64 {
+	data, err := os.ReadFile(cgroupV2Max)
+	if err != nil {
+		return float64(runtime.NumCPU())
+	}
+	return parseCPUMax(string(data))
+}
+
+func cgroupV1Cores() float64 {
+	quota, err := readInt(cgroupV1Quota)
+	if err != nil || quota <= 0 {
+		return float64(runtime.NumCPU())
+	}
+	period, err := readInt(cgroupV1Period)
+	if err != nil || period <= 0 {
+		return float64(runtime.NumCPU())
+	}
+	return float64(quota) / float64(period)
+}
+
+// parseCPUMax cpu.max 的格式是 "$MAX $PERIOD",没有限制的时候 $MAX 是 max
+func parseCPUMax(data string) float64 {
+	fields := strings.Fields(data)
+	if len(fields) != 2 || fields[0] == "max" {
+		return float64(runtime.NumCPU())
+	}
+	quota, err1 := strconv.ParseFloat(fields[0], 64)
+	period, err2 := strconv.ParseFloat(fields[1], 64)
+	if err1 != nil || err2 != nil || quota <= 0 || period <= 0 {
+		return float64(runtime.NumCPU())
+	}
+	return quota / period
+}
+
+// parseCgroupV2Usage 读 cpu.stat 里面的 usage_usec
+func parseCgroupV2Usage(data string) (float64, error) {
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "usage_usec" {
+			return strconv.ParseFloat(fields[1], 64)
+		}
+	}
+	return 0, errors.New("shedding: cpu.stat 里面没有 usage_usec")
+}
+
+// parseProcStat 读 /proc/stat 第一行
+// cpu user nice system idle iowait irq softirq steal ...
+func parseProcStat(data string) (busy, total float64, err error) {
+	line, _, _ := strings.Cut(data, "\n")
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, 0, errors.New("shedding: /proc/stat 格式不对")
+	}
+	var idle float64
+	for i, field := range fields[1:] {
+		val, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		total += val
+		// idle 和 iowait
+		if i == 3 || i == 4 {
+			idle += val
+		}
+	}
+	return total - idle, total, nil
+}
+
+func readInt(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
@@ -0,0 +1,43 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package shedding
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCPUMax(t *testing.T) {
+	assert.Equal(t, 2.0, parseCPUMax("200000 100000\n"))
+	assert.Equal(t, float64(runtime.NumCPU()), parseCPUMax("max 100000\n"))
+}
+
+func TestParseCgroupV2Usage(t *testing.T) {
+	usage, err := parseCgroupV2Usage("usage_usec 12345\nuser_usec 10000\nsystem_usec 2345\n")
+	require.NoError(t, err)
+	assert.Equal(t, 12345.0, usage)
+}
+
+func TestParseProcStat(t *testing.T) {
+	busy, total, err := parseProcStat("cpu  100 0 50 800 50 0 0 0 0 0\ncpu0 50 0 25 400 25 0 0 0 0 0\n")
+	require.NoError(t, err)
+	assert.Equal(t, 150.0, busy)
+	assert.Equal(t, 1000.0, total)
+}
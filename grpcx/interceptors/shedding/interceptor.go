@@ -0,0 +1,119 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package shedding
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/bgq98/utils/grpcx/degrade"
+	"github.com/bgq98/utils/internal/metrics"
+	"github.com/bgq98/utils/logger"
+)
+
+// HeaderPriority 调用方通过 metadata 传递优先级,取值 low, normal, critical
+const HeaderPriority = "x-priority"
+
+// WithPriority 客户端设置这次调用的优先级
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, HeaderPriority, p.String())
+}
+
+// PriorityFromContext 服务端读取调用方的优先级,没有的话是 normal
+func PriorityFromContext(ctx context.Context) Priority {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return PriorityNormal
+	}
+	vals := md.Get(HeaderPriority)
+	if len(vals) == 0 {
+		return PriorityNormal
+	}
+	return ParsePriority(vals[0])
+}
+
+// InterceptorBuilder 整个服务共用一个 Limiter,过载的时候返回 ResourceExhausted
+type InterceptorBuilder struct {
+	limiter     *Limiter
+	l           logger.Logger
+	passThrough bool
+
+	registerer     prometheus.Registerer
+	once           sync.Once
+	droppedCounter *prometheus.CounterVec
+}
+
+func NewInterceptorBuilder(l logger.Logger, cfg Config) *InterceptorBuilder {
+	return &InterceptorBuilder{
+		limiter: NewLimiter(cfg),
+		l:       l,
+	}
+}
+
+// PassThrough 放行模式,过载的时候不丢弃请求,
+// 而是设置 degrade.LevelPartial 的降级信号,由业务少做一些非核心的事情
+func (s *InterceptorBuilder) PassThrough(ok bool) *InterceptorBuilder {
+	s.passThrough = ok
+	return s
+}
+
+// Registerer 不设置就注册到 prometheus.DefaultRegisterer
+func (s *InterceptorBuilder) Registerer(r prometheus.Registerer) *InterceptorBuilder {
+	s.registerer = r
+	return s
+}
+
+// initMetrics 用到的时候才注册,只 import 不会注册指标
+func (s *InterceptorBuilder) initMetrics() {
+	s.once.Do(func() {
+		s.droppedCounter = metrics.Register(s.registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpcx_shedding_dropped_total",
+			Help: "自适应限流丢弃的请求数",
+		}, []string{"method", "priority"}))
+	})
+}
+
+func (s *InterceptorBuilder) BuildServerInterceptor() grpc.UnaryServerInterceptor {
+	s.initMetrics()
+	return func(ctx context.Context,
+		req any, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (resp any, err error) {
+		p := PriorityFromContext(ctx)
+		done, err := s.limiter.Allow(p)
+		if err != nil {
+			s.droppedCounter.WithLabelValues(info.FullMethod, p.String()).Inc()
+			s.l.Debug("服务过载,丢弃请求",
+				logger.String("method", info.FullMethod),
+				logger.String("priority", p.String()),
+				logger.Int64("inflight", s.limiter.InFlight()),
+				logger.Int64("max_inflight", s.limiter.MaxInFlight()))
+			if !s.passThrough {
+				return nil, status.Errorf(codes.ResourceExhausted, "服务过载")
+			}
+			done = s.limiter.Admit()
+			ctx = degrade.With(ctx, degrade.LevelPartial, degrade.ReasonOverload)
+		}
+		defer done()
+		return handler(ctx, req)
+	}
+}
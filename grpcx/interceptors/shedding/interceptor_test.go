@@ -0,0 +1,87 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package shedding
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/bgq98/utils/grpcx/degrade"
+	"github.com/bgq98/utils/logger"
+)
+
+func TestInterceptorBuilder_BuildServerInterceptor(t *testing.T) {
+	testCases := []struct {
+		name        string
+		passThrough bool
+		wantCode    codes.Code
+		wantLevel   degrade.Level
+	}{
+		{
+			name:     "丢弃",
+			wantCode: codes.ResourceExhausted,
+		},
+		{
+			name:        "放行",
+			passThrough: true,
+			wantLevel:   degrade.LevelPartial,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l, now := newTestLimiter(t, Config{})
+			// 低优先级最多用到 7 个并发
+			for i := 0; i < 7; i++ {
+				_, err := l.Allow(PriorityCritical)
+				require.NoError(t, err)
+			}
+			b := NewInterceptorBuilder(logger.NewNoOpLogger(), Config{}).PassThrough(tc.passThrough)
+			b.limiter = l
+			interceptor := b.BuildServerInterceptor()
+
+			ctx := metadata.NewIncomingContext(context.Background(),
+				metadata.Pairs(HeaderPriority, PriorityLow.String()))
+			var called bool
+			_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/user.v1.UserService/GetById"},
+				func(ctx context.Context, req any) (any, error) {
+					called = true
+					assert.Equal(t, tc.wantLevel, degrade.LevelFromContext(ctx))
+					// 放行的请求也在占用资源
+					assert.Equal(t, int64(8), l.InFlight())
+					*now = now.Add(time.Millisecond * 30)
+					return nil, nil
+				})
+			assert.Equal(t, tc.wantCode, status.Code(err))
+			assert.Equal(t, tc.passThrough, called)
+			assert.Equal(t, int64(7), l.InFlight())
+			if tc.passThrough {
+				// 耗时也要计入当前的桶
+				bk := l.buckets[l.idx()%int64(len(l.buckets))]
+				assert.Equal(t, int64(1), bk.pass)
+				assert.Equal(t, time.Millisecond*30, bk.rt)
+			}
+		})
+	}
+}
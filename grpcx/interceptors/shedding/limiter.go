@@ -0,0 +1,232 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package shedding
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrOverload 服务过载了,请求需要被丢弃
+var ErrOverload = errors.New("shedding: overload")
+
+// Priority 请求的优先级,过载的时候优先丢弃低优先级的请求
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityCritical
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityCritical:
+		return "critical"
+	default:
+		return "normal"
+	}
+}
+
+// ParsePriority 不认识的都当作 normal
+func ParsePriority(val string) Priority {
+	switch val {
+	case "low":
+		return PriorityLow
+	case "critical":
+		return PriorityCritical
+	default:
+		return PriorityNormal
+	}
+}
+
+// priorityRatio 不同优先级能用到的并发比例,给高优先级的请求预留余量
+var priorityRatio = map[Priority]float64{
+	PriorityLow:      0.7,
+	PriorityNormal:   0.9,
+	PriorityCritical: 1,
+}
+
+// Config 自适应限流的参数
+// 参考 BBR 的思路,根据 Little's Law 用窗口内每个桶最大的通过数和最小的平均耗时
+// 估算系统能承受的最大并发,当前并发超过这个值就丢弃请求
+type Config struct {
+	// Window 滑动窗口的大小,会被分成 Buckets 个桶
+	Window  time.Duration
+	Buckets int
+	// MinSamples 窗口内完成的请求太少的时候估算不准,不会丢弃请求
+	MinSamples int64
+	// CPU 返回 CPU 使用率的千分比,例如 NewCPU 返回的 CPU.Usage
+	// 不设置的话只看并发数,设置了的话只有 CPU 使用率超过 CPUThreshold 才会丢弃请求
+	CPU          func() int64
+	CPUThreshold int64
+	// CoolDown 丢弃请求之后这段时间内即使 CPU 降下来了也继续按照并发数判断,
+	// 避免 CPU 在阈值附近来回抖动
+	CoolDown time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Window:       time.Second * 10,
+		Buckets:      100,
+		MinSamples:   100,
+		CPUThreshold: 800,
+		CoolDown:     time.Second,
+	}
+}
+
+// Limiter 自适应限流器,并发安全
+type Limiter struct {
+	cfg         Config
+	bucketWidth time.Duration
+	now         func() time.Time
+
+	inflight atomic.Int64
+	// lastDrop 上一次丢弃请求的时间,UnixNano
+	lastDrop atomic.Int64
+
+	lock    sync.Mutex
+	buckets []bucket
+	// 最大并发只和已经结束的桶有关,同一个桶的时间片内可以复用
+	cacheIdx int64
+	cacheVal int64
+}
+
+type bucket struct {
+	idx  int64
+	pass int64
+	rt   time.Duration
+}
+
+func NewLimiter(cfg Config) *Limiter {
+	if cfg.Buckets <= 0 {
+		cfg.Buckets = 100
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = time.Second * 10
+	}
+	return &Limiter{
+		cfg:         cfg,
+		bucketWidth: cfg.Window / time.Duration(cfg.Buckets),
+		now:         time.Now,
+		buckets:     make([]bucket, cfg.Buckets),
+		cacheIdx:    -1,
+	}
+}
+
+// Allow 返回 ErrOverload 代表请求要被丢弃
+// 返回 nil 的话,请求结束之后一定要调用 done
+func (l *Limiter) Allow(p Priority) (done func(), err error) {
+	if l.shouldDrop(p, l.inflight.Load()) {
+		l.lastDrop.Store(l.now().UnixNano())
+		return nil, ErrOverload
+	}
+	return l.Admit(), nil
+}
+
+// Admit 不判断是否过载,直接放行,请求结束之后一定要调用 done
+// 放行模式下本该丢弃的请求也在占用资源,要计入并发数和耗时,不然估算出来的最大并发会偏大
+func (l *Limiter) Admit() (done func()) {
+	l.inflight.Add(1)
+	start := l.now()
+	return func() {
+		rt := l.now().Sub(start)
+		l.inflight.Add(-1)
+		l.add(rt)
+	}
+}
+
+// InFlight 当前正在处理的请求数
+func (l *Limiter) InFlight() int64 {
+	return l.inflight.Load()
+}
+
+// MaxInFlight 估算出来的最大并发,0 代表样本不够,不限制
+func (l *Limiter) MaxInFlight() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	cur := l.idx()
+	if l.cacheIdx == cur {
+		return l.cacheVal
+	}
+	// 当前的桶还没结束,通过数偏小,不参与计算
+	minIdx := cur - int64(len(l.buckets)) + 1
+	var total, maxPass int64
+	minRT := time.Duration(math.MaxInt64)
+	for _, bk := range l.buckets {
+		if bk.idx < minIdx || bk.idx >= cur || bk.pass == 0 {
+			continue
+		}
+		total += bk.pass
+		if bk.pass > maxPass {
+			maxPass = bk.pass
+		}
+		if avg := bk.rt / time.Duration(bk.pass); avg < minRT {
+			minRT = avg
+		}
+	}
+	var res int64
+	if total > 0 && total >= l.cfg.MinSamples {
+		// 并发 = 吞吐 * 耗时
+		res = int64(math.Ceil(float64(maxPass) * float64(minRT) / float64(l.bucketWidth)))
+		if res < 1 {
+			res = 1
+		}
+	}
+	l.cacheIdx, l.cacheVal = cur, res
+	return res
+}
+
+func (l *Limiter) shouldDrop(p Priority, inflight int64) bool {
+	if l.cfg.CPU != nil && l.cfg.CPU() < l.cfg.CPUThreshold {
+		lastDrop := l.lastDrop.Load()
+		if lastDrop == 0 || l.now().Sub(time.Unix(0, lastDrop)) > l.cfg.CoolDown {
+			return false
+		}
+	}
+	maxInFlight := l.MaxInFlight()
+	if maxInFlight <= 0 || inflight <= 0 {
+		return false
+	}
+	ratio, ok := priorityRatio[p]
+	if !ok {
+		ratio = priorityRatio[PriorityNormal]
+	}
+	limit := math.Max(1, float64(maxInFlight)*ratio)
+	return float64(inflight) >= limit
+}
+
+func (l *Limiter) add(rt time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	idx := l.idx()
+	bk := &l.buckets[idx%int64(len(l.buckets))]
+	if bk.idx != idx {
+		*bk = bucket{idx: idx}
+	}
+	bk.pass++
+	bk.rt += rt
+}
+
+func (l *Limiter) idx() int64 {
+	return l.now().UnixNano() / int64(l.bucketWidth)
+}
@@ -0,0 +1,107 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package shedding
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestLimiter 窗口里面有一个桶通过了 20 个请求,平均耗时 50ms,
+// 桶宽 100ms,估算出来的最大并发是 20 * 50 / 100 = 10
+func newTestLimiter(t *testing.T, cfg Config) (*Limiter, *time.Time) {
+	cfg.Window = time.Second
+	cfg.Buckets = 10
+	cfg.MinSamples = 10
+	l := NewLimiter(cfg)
+	now := time.Unix(100, 0)
+	l.now = func() time.Time {
+		return now
+	}
+	for i := 0; i < 20; i++ {
+		now = time.Unix(100, 0)
+		done, err := l.Allow(PriorityNormal)
+		require.NoError(t, err)
+		now = now.Add(time.Millisecond * 50)
+		done()
+	}
+	now = time.Unix(100, 0).Add(time.Millisecond * 150)
+	require.Equal(t, int64(10), l.MaxInFlight())
+	return l, &now
+}
+
+func TestLimiter_Allow(t *testing.T) {
+	l, _ := newTestLimiter(t, Config{})
+	for i := 0; i < 7; i++ {
+		_, err := l.Allow(PriorityCritical)
+		require.NoError(t, err)
+	}
+	// 低优先级最多用到 70%
+	_, err := l.Allow(PriorityLow)
+	assert.Equal(t, ErrOverload, err)
+	_, err = l.Allow(PriorityNormal)
+	assert.NoError(t, err)
+	_, err = l.Allow(PriorityCritical)
+	assert.NoError(t, err)
+	// 普通优先级最多用到 90%
+	_, err = l.Allow(PriorityNormal)
+	assert.Equal(t, ErrOverload, err)
+	_, err = l.Allow(PriorityCritical)
+	assert.NoError(t, err)
+	_, err = l.Allow(PriorityCritical)
+	assert.Equal(t, ErrOverload, err)
+}
+
+func TestLimiter_NotEnoughSamples(t *testing.T) {
+	l := NewLimiter(Config{MinSamples: 10})
+	for i := 0; i < 100; i++ {
+		_, err := l.Allow(PriorityLow)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int64(0), l.MaxInFlight())
+}
+
+func TestLimiter_CPU(t *testing.T) {
+	var cpu int64 = 900
+	l, now := newTestLimiter(t, Config{
+		CPU: func() int64 {
+			return cpu
+		},
+		CPUThreshold: 800,
+		CoolDown:     time.Millisecond * 100,
+	})
+	for i := 0; i < 10; i++ {
+		_, err := l.Allow(PriorityCritical)
+		require.NoError(t, err)
+	}
+	_, err := l.Allow(PriorityCritical)
+	assert.Equal(t, ErrOverload, err)
+
+	// CPU 降下来了,但是还在冷却时间内
+	cpu = 100
+	_, err = l.Allow(PriorityCritical)
+	assert.Equal(t, ErrOverload, err)
+
+	// 过了冷却时间,CPU 不高就不丢弃
+	*now = now.Add(time.Millisecond * 200)
+	require.Equal(t, int64(10), l.MaxInFlight())
+	_, err = l.Allow(PriorityCritical)
+	assert.NoError(t, err)
+}
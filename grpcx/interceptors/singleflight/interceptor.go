@@ -0,0 +1,134 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package singleflight
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/bgq98/utils/grpcx/interceptors"
+	"github.com/bgq98/utils/internal/metrics"
+	"github.com/bgq98/utils/logger"
+)
+
+// InterceptorBuilder 把并发的相同请求合并成一个,只有一个请求会调用 handler,其它的等待并共享结果
+// 相同请求指的是方法一样,并且请求确定性序列化之后一样
+// 只适合幂等的,和调用者身份无关的读请求,需要通过 Method 显式开启
+// 注意第一个请求的 ctx 被取消的话,等待它的请求也会拿到同样的错误
+type InterceptorBuilder struct {
+	l        logger.Logger
+	patterns []string
+	group    singleflight.Group
+
+	registerer prometheus.Registerer
+	once       sync.Once
+	// requestCounter result 是 leader 代表真的调用了 handler,shared 代表复用了别人的结果
+	// 合并比例 = shared / (leader + shared)
+	requestCounter *prometheus.CounterVec
+}
+
+func NewInterceptorBuilder(l logger.Logger) *InterceptorBuilder {
+	return &InterceptorBuilder{l: l}
+}
+
+// Method 开启请求合并的方法,支持 * 和前缀匹配,见 interceptors.MatchMethod
+func (s *InterceptorBuilder) Method(patterns ...string) *InterceptorBuilder {
+	s.patterns = append(s.patterns, patterns...)
+	return s
+}
+
+// Registerer 不设置就注册到 prometheus.DefaultRegisterer
+func (s *InterceptorBuilder) Registerer(r prometheus.Registerer) *InterceptorBuilder {
+	s.registerer = r
+	return s
+}
+
+// initMetrics 用到的时候才注册,只 import 不会注册指标
+func (s *InterceptorBuilder) initMetrics() {
+	s.once.Do(func() {
+		s.requestCounter = metrics.Register(s.registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpcx_singleflight_requests_total",
+			Help: "请求合并的请求数",
+		}, []string{"method", "result"}))
+	})
+}
+
+func (s *InterceptorBuilder) BuildServer() grpc.UnaryServerInterceptor {
+	s.initMetrics()
+	return func(ctx context.Context,
+		req any, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (any, error) {
+		if !s.enabled(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		msg, ok := req.(proto.Message)
+		if !ok {
+			return handler(ctx, req)
+		}
+		key, err := s.key(info.FullMethod, msg)
+		if err != nil {
+			s.l.Warn("请求合并计算 key 失败",
+				logger.String("method", info.FullMethod),
+				logger.Error(err))
+			return handler(ctx, req)
+		}
+		leader := false
+		resp, err, shared := s.group.Do(key, func() (any, error) {
+			leader = true
+			return handler(ctx, req)
+		})
+		result := "shared"
+		if leader {
+			result = "leader"
+		}
+		s.requestCounter.WithLabelValues(info.FullMethod, result).Inc()
+		if err != nil {
+			return nil, err
+		}
+		// 大家拿到的是同一个响应,后面的拦截器或者序列化可能会修改它,所以每人一份
+		if pm, ok := resp.(proto.Message); ok && shared {
+			return proto.Clone(pm), nil
+		}
+		return resp, nil
+	}
+}
+
+func (s *InterceptorBuilder) enabled(method string) bool {
+	for _, pattern := range s.patterns {
+		if interceptors.MatchMethod(pattern, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// key 方法 + 请求的哈希,map 字段的顺序不固定,所以要用确定性序列化
+func (s *InterceptorBuilder) key(method string, msg proto.Message) (string, error) {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return method + ":" + hex.EncodeToString(sum[:]), nil
+}
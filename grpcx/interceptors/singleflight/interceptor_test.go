@@ -0,0 +1,92 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package singleflight
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/bgq98/utils/logger"
+)
+
+func TestInterceptorBuilder_BuildServer(t *testing.T) {
+	interceptor := NewInterceptorBuilder(logger.NewNoOpLogger()).
+		Method("/user.v1.UserService/GetById").
+		BuildServer()
+	var calls atomic.Int32
+	release := make(chan struct{})
+	handler := func(ctx context.Context, req any) (any, error) {
+		calls.Add(1)
+		<-release
+		return wrapperspb.String("Tom"), nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/user.v1.UserService/GetById"}
+
+	const n = 10
+	resps := make([]any, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := interceptor(context.Background(), wrapperspb.Int64(123), info, handler)
+			assert.NoError(t, err)
+			resps[i] = resp
+		}(i)
+	}
+	// 等所有请求都进去
+	time.Sleep(time.Millisecond * 100)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls.Load())
+	for i := 1; i < n; i++ {
+		assert.Equal(t, "Tom", resps[i].(*wrapperspb.StringValue).GetValue())
+		// 每人一份
+		assert.NotSame(t, resps[0], resps[i])
+	}
+}
+
+func TestInterceptorBuilder_Disabled(t *testing.T) {
+	interceptor := NewInterceptorBuilder(logger.NewNoOpLogger()).
+		Method("/user.v1.UserService/GetById").
+		BuildServer()
+	var calls atomic.Int32
+	handler := func(ctx context.Context, req any) (any, error) {
+		calls.Add(1)
+		time.Sleep(time.Millisecond * 50)
+		return wrapperspb.String("Tom"), nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/user.v1.UserService/Edit"}
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = interceptor(context.Background(), wrapperspb.Int64(123), info, handler)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(3), calls.Load())
+}
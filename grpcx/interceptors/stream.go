@@ -0,0 +1,181 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package interceptors
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// ServerStream 包装 grpc.ServerStream,统计收发的消息数,也可以替换 ctx
+type ServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+	// OnSend 和 OnRecv 每发送/收到一条消息之后调用,可以为 nil
+	OnSend func(msg any, err error)
+	OnRecv func(msg any, err error)
+
+	sent     atomic.Int64
+	received atomic.Int64
+}
+
+func NewServerStream(ss grpc.ServerStream) *ServerStream {
+	return &ServerStream{
+		ServerStream: ss,
+		ctx:          ss.Context(),
+	}
+}
+
+// WithContext 替换 handler 拿到的 ctx
+func (s *ServerStream) WithContext(ctx context.Context) *ServerStream {
+	s.ctx = ctx
+	return s
+}
+
+func (s *ServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *ServerStream) SendMsg(m any) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.sent.Add(1)
+	}
+	if s.OnSend != nil {
+		s.OnSend(m, err)
+	}
+	return err
+}
+
+func (s *ServerStream) RecvMsg(m any) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.received.Add(1)
+	}
+	if s.OnRecv != nil {
+		s.OnRecv(m, err)
+	}
+	return err
+}
+
+func (s *ServerStream) Sent() int64 {
+	return s.sent.Load()
+}
+
+func (s *ServerStream) Received() int64 {
+	return s.received.Load()
+}
+
+// ClientStream 包装 grpc.ClientStream,统计收发的消息数
+// 客户端的流什么时候结束只能从 RecvMsg 的返回值判断,结束的时候会调用一次 OnFinish
+// 调用方取消了 ctx 或者没读完就丢掉了流(grpc 要求这种情况下取消 ctx),也会调用 OnFinish
+type ClientStream struct {
+	grpc.ClientStream
+	// serverStreams 服务端是不是流式返回,不是的话收到一条消息就结束了
+	serverStreams bool
+	// OnSend 和 OnRecv 每发送/收到一条消息之后调用,可以为 nil
+	OnSend func(msg any, err error)
+	OnRecv func(msg any, err error)
+	// OnFinish 流结束的时候调用,正常结束 err 是 nil
+	OnFinish func(err error)
+
+	sent     atomic.Int64
+	received atomic.Int64
+	once     sync.Once
+	done     chan struct{}
+}
+
+// NewClientStream ctx 是调用方传给拦截器的 ctx
+// 这里不能监听 cs.Context(),流正常结束的时候 grpc 也会取消它,分不出来是不是被取消了
+func NewClientStream(ctx context.Context, cs grpc.ClientStream,
+	desc *grpc.StreamDesc, onFinish func(err error)) *ClientStream {
+	s := &ClientStream{
+		ClientStream:  cs,
+		serverStreams: desc.ServerStreams,
+		OnFinish:      onFinish,
+		done:          make(chan struct{}),
+	}
+	go s.watch(ctx)
+	return s
+}
+
+// watch 流结束之前 ctx 被取消了,就用 ctx 的错误结束流,避免 OnFinish 永远不会被调用
+func (s *ClientStream) watch(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		s.Finish(status.FromContextError(ctx.Err()).Err())
+	case <-s.done:
+	}
+}
+
+func (s *ClientStream) SendMsg(m any) error {
+	err := s.ClientStream.SendMsg(m)
+	if err == nil {
+		s.sent.Add(1)
+	}
+	if s.OnSend != nil {
+		s.OnSend(m, err)
+	}
+	if err != nil && err != io.EOF {
+		// io.EOF 代表服务端已经结束了,真正的错误要从 RecvMsg 拿
+		s.Finish(err)
+	}
+	return err
+}
+
+func (s *ClientStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == nil {
+		s.received.Add(1)
+	}
+	if s.OnRecv != nil {
+		s.OnRecv(m, err)
+	}
+	switch {
+	case err == io.EOF:
+		s.Finish(nil)
+	case err != nil:
+		s.Finish(err)
+	case !s.serverStreams:
+		s.Finish(nil)
+	}
+	return err
+}
+
+// Finish 结束流,重复调用只有第一次生效
+// 建立流失败的时候拦截器也可以直接调用它
+func (s *ClientStream) Finish(err error) {
+	s.once.Do(func() {
+		close(s.done)
+		if s.OnFinish != nil {
+			s.OnFinish(err)
+		}
+	})
+}
+
+func (s *ClientStream) Sent() int64 {
+	return s.sent.Load()
+}
+
+func (s *ClientStream) Received() int64 {
+	return s.received.Load()
+}
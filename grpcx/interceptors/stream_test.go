@@ -0,0 +1,222 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package interceptors
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	sendErr error
+	recvErr error
+}
+
+func (s *fakeServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeServerStream) SendMsg(m any) error {
+	return s.sendErr
+}
+
+func (s *fakeServerStream) RecvMsg(m any) error {
+	return s.recvErr
+}
+
+// fakeClientStream RecvMsg 按照顺序返回 recvErrs
+type fakeClientStream struct {
+	grpc.ClientStream
+	sendErr  error
+	recvErrs []error
+}
+
+func (s *fakeClientStream) SendMsg(m any) error {
+	return s.sendErr
+}
+
+func (s *fakeClientStream) RecvMsg(m any) error {
+	err := s.recvErrs[0]
+	s.recvErrs = s.recvErrs[1:]
+	return err
+}
+
+type ctxKey struct{}
+
+func TestServerStream(t *testing.T) {
+	ss := &fakeServerStream{ctx: context.Background()}
+	stream := NewServerStream(ss)
+	var sent, received int
+	stream.OnSend = func(msg any, err error) {
+		sent++
+	}
+	stream.OnRecv = func(msg any, err error) {
+		received++
+	}
+	assert.NoError(t, stream.SendMsg("a"))
+	assert.NoError(t, stream.SendMsg("b"))
+	assert.NoError(t, stream.RecvMsg("c"))
+
+	// 失败的消息不计数,但是回调还是要调用
+	ss.sendErr = errors.New("发送失败")
+	ss.recvErr = io.EOF
+	assert.Error(t, stream.SendMsg("d"))
+	assert.Equal(t, io.EOF, stream.RecvMsg("e"))
+
+	assert.Equal(t, int64(2), stream.Sent())
+	assert.Equal(t, int64(1), stream.Received())
+	assert.Equal(t, 3, sent)
+	assert.Equal(t, 2, received)
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "value")
+	assert.Equal(t, "value", stream.WithContext(ctx).Context().Value(ctxKey{}))
+}
+
+func TestClientStream_Finish(t *testing.T) {
+	testCases := []struct {
+		name          string
+		serverStreams bool
+		sendErr       error
+		recvErrs      []error
+		// send 先发送一条消息
+		send    bool
+		recv    int
+		wantErr error
+		// wantFinish 是不是应该结束了
+		wantFinish   bool
+		wantReceived int64
+	}{
+		{
+			name:          "流式返回,读到 EOF 才结束",
+			serverStreams: true,
+			recvErrs:      []error{nil, nil, io.EOF},
+			recv:          3,
+			wantFinish:    true,
+			wantReceived:  2,
+		},
+		{
+			name:          "流式返回,还没读完",
+			serverStreams: true,
+			recvErrs:      []error{nil, nil, io.EOF},
+			recv:          2,
+			wantReceived:  2,
+		},
+		{
+			name:         "只返回一条消息,收到就结束",
+			recvErrs:     []error{nil},
+			recv:         1,
+			wantFinish:   true,
+			wantReceived: 1,
+		},
+		{
+			name:          "RecvMsg 出错",
+			serverStreams: true,
+			recvErrs:      []error{nil, status.Error(codes.Internal, "数据库错误")},
+			recv:          2,
+			wantErr:       status.Error(codes.Internal, "数据库错误"),
+			wantFinish:    true,
+			wantReceived:  1,
+		},
+		{
+			name:       "SendMsg 出错",
+			sendErr:    status.Error(codes.Unavailable, "连接断开"),
+			send:       true,
+			wantErr:    status.Error(codes.Unavailable, "连接断开"),
+			wantFinish: true,
+		},
+		{
+			name:    "SendMsg 返回 EOF,要等 RecvMsg",
+			sendErr: io.EOF,
+			send:    true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var finished int
+			var finishErr error
+			cs := &fakeClientStream{sendErr: tc.sendErr, recvErrs: tc.recvErrs}
+			stream := NewClientStream(context.Background(), cs,
+				&grpc.StreamDesc{ServerStreams: tc.serverStreams}, func(err error) {
+					finished++
+					finishErr = err
+				})
+			if tc.send {
+				_ = stream.SendMsg("req")
+			}
+			for i := 0; i < tc.recv; i++ {
+				_ = stream.RecvMsg("resp")
+			}
+			assert.Equal(t, tc.wantReceived, stream.Received())
+			if !tc.wantFinish {
+				assert.Equal(t, 0, finished)
+				return
+			}
+			assert.Equal(t, 1, finished)
+			assert.Equal(t, tc.wantErr, finishErr)
+			// 重复调用不生效
+			stream.Finish(errors.New("重复结束"))
+			assert.Equal(t, 1, finished)
+			assert.Equal(t, tc.wantErr, finishErr)
+		})
+	}
+}
+
+// TestClientStream_Cancel 调用方取消了 ctx,不再读取流,也要结束
+func TestClientStream_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan error, 1)
+	stream := NewClientStream(ctx, &fakeClientStream{},
+		&grpc.StreamDesc{ServerStreams: true}, func(err error) {
+			finished <- err
+		})
+	cancel()
+	select {
+	case err := <-finished:
+		assert.Equal(t, codes.Canceled, status.Code(err))
+	case <-time.After(time.Second):
+		t.Fatal("ctx 取消之后没有结束流")
+	}
+	// 已经结束了,不会再调用
+	stream.Finish(nil)
+	assert.Len(t, finished, 0)
+}
+
+// TestClientStream_CancelAfterFinish 流正常结束之后再取消 ctx,不能覆盖结果
+func TestClientStream_CancelAfterFinish(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var errs []error
+	stream := NewClientStream(ctx, &fakeClientStream{recvErrs: []error{io.EOF}},
+		&grpc.StreamDesc{ServerStreams: true}, func(err error) {
+			errs = append(errs, err)
+		})
+	require.Equal(t, io.EOF, stream.RecvMsg("resp"))
+	cancel()
+	// watch 的 goroutine 已经退出了
+	<-stream.done
+	assert.Equal(t, []error{nil}, errs)
+}
@@ -0,0 +1,140 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package timeout
+
+import (
+	"context"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bgq98/utils/grpcx/interceptors"
+	"github.com/bgq98/utils/logger"
+)
+
+type rule struct {
+	pattern string
+	timeout time.Duration
+}
+
+// InterceptorBuilder 超时控制
+// 客户端:调用方没有设置超时时间的时候,按照方法设置默认的超时时间
+// 服务端:剩余时间不够处理请求的时候直接拒绝,免得做无用功
+// 剩余时间是 grpc 自己通过 grpc-timeout 传递的,HTTP 那一侧见 ginx/middlewares/timeout
+type InterceptorBuilder struct {
+	l              logger.Logger
+	defaultTimeout time.Duration
+	rules          []rule
+	minBudget      time.Duration
+}
+
+func NewInterceptorBuilder(l logger.Logger) *InterceptorBuilder {
+	return &InterceptorBuilder{
+		l: l,
+	}
+}
+
+// Default 所有方法默认的超时时间,0 代表不设置
+func (b *InterceptorBuilder) Default(timeout time.Duration) *InterceptorBuilder {
+	b.defaultTimeout = timeout
+	return b
+}
+
+// Method 某些方法的超时时间,写法见 interceptors.MatchMethod,先添加的优先
+func (b *InterceptorBuilder) Method(pattern string, timeout time.Duration) *InterceptorBuilder {
+	b.rules = append(b.rules, rule{pattern: pattern, timeout: timeout})
+	return b
+}
+
+// MinBudget 服务端剩余时间少于这个值就直接拒绝
+func (b *InterceptorBuilder) MinBudget(budget time.Duration) *InterceptorBuilder {
+	b.minBudget = budget
+	return b
+}
+
+func (b *InterceptorBuilder) BuildClient() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context,
+		method string, req, reply any,
+		cc *grpc.ClientConn, invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption) error {
+		ctx, cancel := b.withTimeout(ctx, method)
+		defer cancel()
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+func (b *InterceptorBuilder) BuildServer() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context,
+		req any, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (resp any, err error) {
+		if deadline, ok := ctx.Deadline(); ok {
+			remaining := time.Until(deadline)
+			if remaining <= 0 || remaining < b.minBudget {
+				b.l.Warn("剩余时间不足,拒绝请求",
+					logger.String("method", info.FullMethod),
+					logger.Int64("remaining_ms", remaining.Milliseconds()))
+				return nil, status.Errorf(codes.DeadlineExceeded, "剩余时间不足")
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// withTimeout 已经有超时时间的就不动,*gin.Context 的超时时间在 Request 里面
+// *gin.Context 可能已经被前面的拦截器(例如 trace)包了一层,所以要通过 gin.ContextKey 取。
+// 还是从 ctx 派生,不然前面拦截器放进去的 metadata 就丢了,
+// 但是 *gin.Context 本身不会被取消,所以 Request 的 ctx 取消的时候也要跟着取消
+func (b *InterceptorBuilder) withTimeout(ctx context.Context, method string) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	if gc, ok := ctx.Value(gin.ContextKey).(*gin.Context); ok && gc.Request != nil {
+		reqCtx := gc.Request.Context()
+		if deadline, ok := reqCtx.Deadline(); ok {
+			ctx, cancel := context.WithDeadline(ctx, deadline)
+			if reqCtx.Err() != nil {
+				cancel()
+				return ctx, cancel
+			}
+			go func() {
+				select {
+				case <-reqCtx.Done():
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			return ctx, cancel
+		}
+	}
+	timeout := b.timeout(method)
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (b *InterceptorBuilder) timeout(method string) time.Duration {
+	for _, r := range b.rules {
+		if interceptors.MatchMethod(r.pattern, method) {
+			return r.timeout
+		}
+	}
+	return b.defaultTimeout
+}
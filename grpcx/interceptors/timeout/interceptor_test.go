@@ -0,0 +1,245 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package timeout
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	"google.golang.org/grpc/status"
+
+	"github.com/bgq98/utils/grpcx"
+	"github.com/bgq98/utils/grpcx/interceptors/trace"
+	"github.com/bgq98/utils/logger"
+)
+
+func TestInterceptorBuilder_BuildClient(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	testCases := []struct {
+		name   string
+		ctx    func() (context.Context, context.CancelFunc)
+		method string
+		// wantTimeout 大概的剩余时间,0 代表没有超时时间
+		wantTimeout time.Duration
+	}{
+		{
+			name: "已经有超时时间",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), time.Second*5)
+			},
+			method:      "/user.v1.UserService/GetById",
+			wantTimeout: time.Second * 5,
+		},
+		{
+			name: "默认超时时间",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.Background(), func() {}
+			},
+			method:      "/user.v1.UserService/GetById",
+			wantTimeout: time.Second,
+		},
+		{
+			name: "方法的超时时间",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.Background(), func() {}
+			},
+			method:      "/user.v1.UserService/Export",
+			wantTimeout: time.Second * 10,
+		},
+		{
+			name: "方法不设置超时时间",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.Background(), func() {}
+			},
+			method: "/user.v1.UserService/Watch",
+		},
+		{
+			name: "gin.Context",
+			ctx: func() (context.Context, context.CancelFunc) {
+				gc, _ := gin.CreateTestContext(httptest.NewRecorder())
+				reqCtx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+				gc.Request = httptest.NewRequest(http.MethodGet, "/", nil).WithContext(reqCtx)
+				return gc, cancel
+			},
+			method:      "/user.v1.UserService/GetById",
+			wantTimeout: time.Second * 3,
+		},
+	}
+	interceptor := NewInterceptorBuilder(logger.NewNoOpLogger()).
+		Default(time.Second).
+		Method("/user.v1.UserService/Export", time.Second*10).
+		Method("/user.v1.UserService/Watch", 0).
+		BuildClient()
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := tc.ctx()
+			defer cancel()
+			err := interceptor(ctx, tc.method, nil, nil, nil,
+				func(ctx context.Context, method string, req, reply any,
+					cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+					deadline, ok := ctx.Deadline()
+					if tc.wantTimeout == 0 {
+						assert.False(t, ok)
+						return nil
+					}
+					assert.True(t, ok)
+					assert.InDelta(t, tc.wantTimeout, time.Until(deadline), float64(time.Millisecond*100))
+					return nil
+				})
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// TestInterceptorBuilder_BuildClient_ginCancel HTTP 请求被取消了,gRPC 调用也要跟着取消
+func TestInterceptorBuilder_BuildClient_ginCancel(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	gc, _ := gin.CreateTestContext(httptest.NewRecorder())
+	reqCtx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	gc.Request = httptest.NewRequest(http.MethodGet, "/", nil).WithContext(reqCtx)
+	cancel()
+	interceptor := NewInterceptorBuilder(logger.NewNoOpLogger()).BuildClient()
+	err := interceptor(gc, "/user.v1.UserService/GetById", nil, nil, nil,
+		func(ctx context.Context, method string, req, reply any,
+			cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			return ctx.Err()
+		})
+	assert.Equal(t, context.Canceled, err)
+}
+
+// TestInterceptorBuilder_BuildClient_chain 按照 grpcx.ClientBuilder 的顺序,trace 在前面,
+// 传进来的 *gin.Context 已经被 trace 包了一层,超时时间还是要用 Request 的,trace 放进去的 metadata 也不能丢
+func TestInterceptorBuilder_BuildClient_chain(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var (
+		remaining time.Duration
+		header    []string
+	)
+	server := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context,
+		req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if deadline, ok := ctx.Deadline(); ok {
+			remaining = time.Until(deadline)
+		}
+		md, _ := metadata.FromIncomingContext(ctx)
+		header = md.Get("x-test")
+		return handler(ctx, req)
+	}))
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go func() {
+		_ = server.Serve(l)
+	}()
+	defer server.Stop()
+
+	r := manual.NewBuilderWithScheme("test")
+	r.InitialState(resolver.State{Addresses: []resolver.Address{{Addr: l.Addr().String()}}})
+	conn, err := grpcx.NewClientBuilder(nil, "user").
+		Resolver(r).
+		Trace(trace.NewInterceptorBuilder(noop.NewTracerProvider().Tracer("test"), testPropagator{}).BuildClient()).
+		Timeout(NewInterceptorBuilder(logger.NewNoOpLogger()).Default(time.Second).BuildClient()).
+		Build()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	gc, _ := gin.CreateTestContext(httptest.NewRecorder())
+	reqCtx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	gc.Request = httptest.NewRequest(http.MethodGet, "/", nil).WithContext(reqCtx)
+	_, err = healthpb.NewHealthClient(conn).Check(gc, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	assert.InDelta(t, time.Second*3, remaining, float64(time.Millisecond*100))
+	assert.Equal(t, []string{"test"}, header)
+}
+
+// testPropagator 不管有没有 span 都写一个固定的 header,用来确认 trace 放进 ctx 的 metadata 没有丢
+type testPropagator struct{}
+
+func (testPropagator) Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	carrier.Set("x-test", "test")
+}
+
+func (testPropagator) Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	return ctx
+}
+
+func (testPropagator) Fields() []string {
+	return []string{"x-test"}
+}
+
+func TestInterceptorBuilder_BuildServer(t *testing.T) {
+	testCases := []struct {
+		name     string
+		timeout  time.Duration
+		wantCode codes.Code
+	}{
+		{
+			name: "没有超时时间",
+		},
+		{
+			name:    "剩余时间足够",
+			timeout: time.Second,
+		},
+		{
+			name:     "剩余时间不够",
+			timeout:  time.Millisecond * 10,
+			wantCode: codes.DeadlineExceeded,
+		},
+		{
+			name:     "已经超时",
+			timeout:  -time.Second,
+			wantCode: codes.DeadlineExceeded,
+		},
+	}
+	interceptor := NewInterceptorBuilder(logger.NewNoOpLogger()).
+		MinBudget(time.Millisecond * 100).
+		BuildServer()
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.timeout != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.timeout)
+				defer cancel()
+			}
+			var called bool
+			_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/user.v1.UserService/GetById"},
+				func(ctx context.Context, req any) (any, error) {
+					called = true
+					return nil, nil
+				})
+			assert.Equal(t, tc.wantCode, status.Code(err))
+			assert.Equal(t, tc.wantCode == codes.OK, called)
+		})
+	}
+}
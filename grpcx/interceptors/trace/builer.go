@@ -19,7 +19,6 @@ package trace
 import (
 	"context"
 
-	"github.com/go-kratos/kratos/v2/errors"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
@@ -28,6 +27,7 @@ import (
 	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	"github.com/bgq98/utils/grpcx/interceptors"
 )
@@ -45,7 +45,7 @@ func NewInterceptorBuilder(tracer trace.Tracer, propagator propagation.TextMapPr
 	}
 }
 
-func (s *InterceptorBuilder) BuildClient() grpc.UnaryClientInterceptor {
+func (s *InterceptorBuilder) propagatorAndTracer() (propagation.TextMapPropagator, trace.Tracer) {
 	propagator := s.propagator
 	if propagator == nil {
 		propagator = otel.GetTextMapPropagator()
@@ -54,6 +54,11 @@ func (s *InterceptorBuilder) BuildClient() grpc.UnaryClientInterceptor {
 	if tracer == nil {
 		tracer = otel.Tracer("github.com/bgq98/utils/grpcx/interceptors/trace")
 	}
+	return propagator, tracer
+}
+
+func (s *InterceptorBuilder) BuildClient() grpc.UnaryClientInterceptor {
+	propagator, tracer := s.propagatorAndTracer()
 	attrs := []attribute.KeyValue{
 		semconv.RPCSystemKey.String("grpc"),
 		attribute.Key("rpc.grpc.kind").String("unary"),
@@ -65,19 +70,8 @@ func (s *InterceptorBuilder) BuildClient() grpc.UnaryClientInterceptor {
 		ctx, span := tracer.Start(ctx, method,
 			trace.WithAttributes(attrs...),
 			trace.WithSpanKind(trace.SpanKindClient))
-		defer span.End()
-
 		defer func() {
-			if err != nil {
-				span.RecordError(err)
-				if e := errors.FromError(err); e != nil {
-					span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int64(int64(e.Code)))
-				}
-				span.SetStatus(codes.Error, err.Error())
-			} else {
-				span.SetStatus(codes.Ok, "OK")
-			}
-			span.End()
+			endSpan(span, err)
 		}()
 
 		// inject 过程
@@ -119,14 +113,7 @@ func inject(ctx context.Context, propagators propagation.TextMapPropagator) cont
 }
 
 func (s *InterceptorBuilder) BuildServer() grpc.UnaryServerInterceptor {
-	propagator := s.propagator
-	if propagator == nil {
-		propagator = otel.GetTextMapPropagator()
-	}
-	tracer := s.tracer
-	if tracer == nil {
-		tracer = otel.Tracer("github.com/bgq98/utils/grpcx/interceptors/trace")
-	}
+	propagator, tracer := s.propagatorAndTracer()
 	attrs := []attribute.KeyValue{
 		semconv.RPCSystemKey.String("grpc"),
 		attribute.Key("rpc.grpc.kind").String("unary"),
@@ -164,3 +151,85 @@ func extract(ctx context.Context, p propagation.TextMapPropagator) context.Conte
 	}
 	return p.Extract(ctx, GrpHeaderCarrier(md))
 }
+
+// BuildStreamClient 每个流一个 span,每条消息记录一个事件,流结束的时候 span 才结束
+func (s *InterceptorBuilder) BuildStreamClient() grpc.StreamClientInterceptor {
+	propagator, tracer := s.propagatorAndTracer()
+	attrs := []attribute.KeyValue{
+		semconv.RPCSystemKey.String("grpc"),
+		attribute.Key("rpc.grpc.kind").String("stream"),
+		attribute.Key("rpc.component").String("client"),
+	}
+	return func(ctx context.Context, desc *grpc.StreamDesc,
+		cc *grpc.ClientConn, method string,
+		streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		ctx, span := tracer.Start(ctx, method,
+			trace.WithAttributes(attrs...),
+			trace.WithSpanKind(trace.SpanKindClient))
+		ctx = inject(ctx, propagator)
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			endSpan(span, err)
+			return nil, err
+		}
+		stream := interceptors.NewClientStream(ctx, cs, desc, func(err error) {
+			endSpan(span, err)
+		})
+		stream.OnSend = messageEvent(span, "SENT", stream.Sent)
+		stream.OnRecv = messageEvent(span, "RECEIVED", stream.Received)
+		return stream, nil
+	}
+}
+
+// BuildStreamServer 每个流一个 span,每条消息记录一个事件
+func (s *InterceptorBuilder) BuildStreamServer() grpc.StreamServerInterceptor {
+	propagator, tracer := s.propagatorAndTracer()
+	attrs := []attribute.KeyValue{
+		semconv.RPCSystemKey.String("grpc"),
+		attribute.Key("rpc.grpc.kind").String("stream"),
+		attribute.Key("rpc.component").String("server"),
+	}
+	return func(srv any, ss grpc.ServerStream,
+		info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		ctx := extract(ss.Context(), propagator)
+		ctx, span := tracer.Start(ctx, info.FullMethod,
+			trace.WithAttributes(attrs...),
+			trace.WithSpanKind(trace.SpanKindServer))
+		span.SetAttributes(
+			semconv.RPCMethodKey.String(info.FullMethod),
+			semconv.NetPeerNameKey.String(s.PeerName(ctx)),
+			attribute.Key("net.peer.ip").String(s.PeerIP(ctx)),
+		)
+		defer func() {
+			endSpan(span, err)
+		}()
+		stream := interceptors.NewServerStream(ss).WithContext(ctx)
+		stream.OnSend = messageEvent(span, "SENT", stream.Sent)
+		stream.OnRecv = messageEvent(span, "RECEIVED", stream.Received)
+		err = handler(srv, stream)
+		return
+	}
+}
+
+func messageEvent(span trace.Span, typ string, id func() int64) func(msg any, err error) {
+	return func(msg any, err error) {
+		if err != nil {
+			return
+		}
+		span.AddEvent("message", trace.WithAttributes(
+			attribute.Key("message.type").String(typ),
+			attribute.Key("message.id").Int64(id()),
+		))
+	}
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int64(int64(status.Code(err))))
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.SetStatus(codes.Ok, "OK")
+	}
+	span.End()
+}
@@ -20,27 +20,73 @@ import (
 	"context"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"go.etcd.io/etcd/client/v3/naming/endpoints"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 
+	"github.com/bgq98/utils/grpcx/backoff"
+	balancerx "github.com/bgq98/utils/grpcx/balancer"
+	"github.com/bgq98/utils/internal/metrics"
 	"github.com/bgq98/utils/logger"
 	"github.com/bgq98/utils/next"
 )
 
 type Server struct {
 	*grpc.Server
-	Port        int
-	EtcdAddrs   []string
-	EtcdTTL     int64
-	EtcdClient  *clientv3.Client
+	Port       int
+	EtcdAddrs  []string
+	EtcdTTL    int64
+	EtcdClient *clientv3.Client
+	Name       string
+	L          logger.Logger
+	// RetryBackoff 租约丢失之后重新注册的退避策略,不设置默认 1s 起步,最多 30s
+	RetryBackoff backoff.Exponential
+	// IPResolver 注册到 etcd 上的 ip,不设置就用默认的 next.IPResolver
+	IPResolver *next.IPResolver
+	// Registerer 注册 grpcx_server_etcd_registered 指标,不设置就注册到 prometheus.DefaultRegisterer
+	Registerer prometheus.Registerer
+
+	// 下面这些会作为节点的元数据注册到 etcd 上,客户端的负载均衡算法会用到
+	// Weight 权重,不设置默认是 balancer.DefaultWeight,运行期间要修改请用 SetWeight
+	// 下线之前可以 SetWeight(0) 摘掉流量
+	Weight  int
+	Labels  []string
+	Version string
+	Zone    string
+	// Metadata 其它自定义的元数据,和上面的字段重名的时候以上面的字段为准
+	Metadata map[string]any
+
+	// DrainDelay 从 etcd 删除节点之后等多久再开始关闭,
+	// 给客户端留出时间感知到节点下线,不设置默认 2s
+	DrainDelay time.Duration
+	// StopTimeout 优雅退出最多等多久,超时之后强制关闭,不设置默认 10s
+	StopTimeout time.Duration
+
 	etcdManager endpoints.Manager
 	etcdKey     string
-	cancel      func()
-	Name        string
-	L           logger.Logger
+	addr        string
+	// mu 保护 Weight 和 leaseID,避免更新元数据和重新注册并发
+	mu      sync.Mutex
+	leaseID clientv3.LeaseID
+	// weightSet 调用过 SetWeight,这个时候 0 就是真的 0,不再使用默认权重
+	weightSet bool
+	cancel    func()
+	// done 续约的 goroutine 退出之后会关闭
+	done       chan struct{}
+	registered atomic.Bool
+	// registeredGauge 记录服务在 etcd 上的注册状态,1 代表已注册,0 代表租约丢失
+	gaugeOnce       sync.Once
+	registeredGauge *prometheus.GaugeVec
+
+	healthOnce sync.Once
+	health     *health.Server
 }
 
 func (s *Server) Serve() error {
@@ -48,15 +94,53 @@ func (s *Server) Serve() error {
 	if err != nil {
 		return err
 	}
+	// 必须在 Serve 之前注册健康检查服务
+	hs := s.healthServer()
 	err = s.register()
 	if err != nil {
+		_ = l.Close()
 		return err
 	}
+	hs.SetServingStatus(s.Name, healthpb.HealthCheckResponse_SERVING)
 	return s.Server.Serve(l)
 }
 
+// healthServer 注册标准的 grpc.health.v1.Health 服务,
+// 整体的状态(service 为空)默认就是 SERVING
+func (s *Server) healthServer() *health.Server {
+	s.healthOnce.Do(func() {
+		s.health = health.NewServer()
+		healthpb.RegisterHealthServer(s.Server, s.health)
+	})
+	return s.health
+}
+
+// SetServingStatus 运行期间修改某个服务的健康状态,service 为空代表整个 Server
+// 例如依赖的数据库挂了,可以把对应的服务设置为 NOT_SERVING
+func (s *Server) SetServingStatus(service string, status healthpb.HealthCheckResponse_ServingStatus) {
+	s.healthServer().SetServingStatus(service, status)
+}
+
+// Registered 当前是否注册在 etcd 上
+func (s *Server) Registered() bool {
+	return s.registered.Load()
+}
+
 // 使用 etcd 作为注册中心
 func (s *Server) register() error {
+	if s.L == nil {
+		s.L = logger.NewNoOpLogger()
+	}
+	if s.RetryBackoff.Initial <= 0 {
+		s.RetryBackoff = backoff.NewExponential(time.Second, time.Second*30)
+	}
+	if s.IPResolver == nil {
+		s.IPResolver = &next.IPResolver{}
+	}
+	ip, err := s.IPResolver.Resolve()
+	if err != nil {
+		return err
+	}
 	cli, err := clientv3.New(clientv3.Config{
 		Endpoints: s.EtcdAddrs,
 	})
@@ -69,48 +153,229 @@ func (s *Server) register() error {
 	if err != nil {
 		return err
 	}
-	addr := next.GetOutboundIp() + ":" + strconv.Itoa(s.Port)
-	key := "service/" + s.Name + "/" + addr
-	s.etcdKey = key
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	leaseResp, err := cli.Grant(ctx, s.EtcdTTL)
-
-	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	err = em.AddEndpoint(ctx, key, endpoints.Endpoint{
-		Addr: addr,
-	}, clientv3.WithLease(leaseResp.ID))
+	s.etcdManager = em
+	// IPv6 的地址要加上方括号
+	s.addr = net.JoinHostPort(ip, strconv.Itoa(s.Port))
+	s.etcdKey = serviceName + "/" + s.addr
 
 	kaCtx, kaCancel := context.WithCancel(context.Background())
-	s.cancel = kaCancel
-	ch, err := cli.KeepAlive(kaCtx, leaseResp.ID)
+	ch, err := s.doRegister(kaCtx)
 	if err != nil {
+		kaCancel()
 		return err
 	}
-	go func() {
+	s.cancel = kaCancel
+	s.done = make(chan struct{})
+	go s.keepAlive(kaCtx, ch)
+	return nil
+}
+
+// doRegister 申请租约,注册节点并且开始续约
+func (s *Server) doRegister(ctx context.Context) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	grantCtx, cancel := context.WithTimeout(ctx, time.Second)
+	leaseResp, err := s.EtcdClient.Grant(grantCtx, s.EtcdTTL)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	err = s.addEndpoint(ctx, leaseResp.ID)
+	if err == nil {
+		s.leaseID = leaseResp.ID
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	ch, err := s.EtcdClient.KeepAlive(ctx, leaseResp.ID)
+	if err != nil {
+		return nil, err
+	}
+	s.setRegistered(true)
+	return ch, nil
+}
+
+// addEndpoint 调用者需要持有 mu
+func (s *Server) addEndpoint(ctx context.Context, leaseID clientv3.LeaseID) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	return s.etcdManager.AddEndpoint(ctx, s.etcdKey, endpoints.Endpoint{
+		Addr:     s.addr,
+		Metadata: s.endpointMetadata(),
+	}, clientv3.WithLease(leaseID))
+}
+
+// endpointMetadata 调用者需要持有 mu
+func (s *Server) endpointMetadata() map[string]any {
+	md := make(map[string]any, len(s.Metadata)+4)
+	for k, v := range s.Metadata {
+		md[k] = v
+	}
+	// 一定要带上权重,客户端没有拿到权重的时候会使用默认权重
+	weight := s.Weight
+	if weight == 0 && !s.weightSet {
+		weight = balancerx.DefaultWeight
+	}
+	md["weight"] = weight
+	if len(s.Labels) > 0 {
+		md["labels"] = s.Labels
+	}
+	if s.Version != "" {
+		md["version"] = s.Version
+	}
+	if s.Zone != "" {
+		md["zone"] = s.Zone
+	}
+	return md
+}
+
+// SetWeight 运行期间修改权重,例如下线之前把权重调低来摘流量
+// 如果当前租约丢失了,会在重新注册的时候带上新的权重
+func (s *Server) SetWeight(weight int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Weight = weight
+	s.weightSet = true
+	if s.etcdManager == nil || !s.Registered() {
+		return nil
+	}
+	return s.addEndpoint(context.Background(), s.leaseID)
+}
+
+// keepAlive 续约,channel 被关闭说明租约丢失了(网络分区, etcd 重启等)
+// 这个时候要重新申请租约并且重新注册,直到 Close 被调用
+func (s *Server) keepAlive(ctx context.Context, ch <-chan *clientv3.LeaseKeepAliveResponse) {
+	defer close(s.done)
+	for {
 		for kaResp := range ch {
 			s.L.Debug(kaResp.String())
 		}
-	}()
-	return nil
+		if ctx.Err() != nil {
+			// 主动关闭的
+			return
+		}
+		s.setRegistered(false)
+		s.L.Warn("etcd 租约丢失,准备重新注册", logger.String("key", s.etcdKey))
+		ch = s.reRegister(ctx)
+		if ch == nil {
+			return
+		}
+	}
+}
+
+// reRegister 按照退避策略不断重试,ctx 被取消的时候返回 nil
+func (s *Server) reRegister(ctx context.Context) <-chan *clientv3.LeaseKeepAliveResponse {
+	for attempt := 0; ; attempt++ {
+		timer := time.NewTimer(s.RetryBackoff.Next(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+		ch, err := s.doRegister(ctx)
+		if err == nil {
+			s.L.Info("重新注册 etcd 成功",
+				logger.String("key", s.etcdKey),
+				logger.Int64("attempt", int64(attempt+1)))
+			return ch
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		s.L.Error("重新注册 etcd 失败",
+			logger.String("key", s.etcdKey),
+			logger.Int64("attempt", int64(attempt+1)),
+			logger.Error(err))
+	}
 }
 
+func (s *Server) setRegistered(ok bool) {
+	s.registered.Store(ok)
+	val := 0.0
+	if ok {
+		val = 1
+	}
+	s.gauge().WithLabelValues(s.Name).Set(val)
+}
+
+// gauge 用到的时候才注册,同一个进程里面的多个 Server 共用一个指标
+func (s *Server) gauge() *prometheus.GaugeVec {
+	s.gaugeOnce.Do(func() {
+		s.registeredGauge = metrics.Register(s.Registerer, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "grpcx_server_etcd_registered",
+			Help: "grpc 服务在 etcd 上的注册状态,1 已注册,0 未注册",
+		}, []string{"service"}))
+	})
+	return s.registeredGauge
+}
+
+// Close 按照下面的顺序下线:
+// 1. 健康检查切换到 NOT_SERVING,不再接受新的健康检查探测
+// 2. 停止续约并且从 etcd 上删除节点
+// 3. 删除了节点的话等待 DrainDelay,让客户端感知到节点下线
+// 4. 优雅退出,等待正在处理的请求结束,超过 StopTimeout 强制关闭
 func (s *Server) Close() error {
+	if s.L == nil {
+		s.L = logger.NewNoOpLogger()
+	}
+	if s.health != nil {
+		s.health.Shutdown()
+	}
+	deregistered, err := s.deregister()
+
+	// 没有从 etcd 上删除节点,客户端也就没有什么需要感知的,不用等
+	if deregistered {
+		drainDelay := s.DrainDelay
+		if drainDelay <= 0 {
+			drainDelay = time.Second * 2
+		}
+		time.Sleep(drainDelay)
+	}
+
+	stopTimeout := s.StopTimeout
+	if stopTimeout <= 0 {
+		stopTimeout = time.Second * 10
+	}
+	stopped := make(chan struct{})
+	go func() {
+		s.Server.GracefulStop()
+		close(stopped)
+	}()
+	timer := time.NewTimer(stopTimeout)
+	defer timer.Stop()
+	select {
+	case <-stopped:
+	case <-timer.C:
+		s.L.Warn("优雅退出超时,强制关闭", logger.String("service", s.Name))
+		s.Server.Stop()
+	}
+	return err
+}
+
+// deregister 停止续约,从 etcd 上删除节点,deregistered 代表节点确实被删除了
+func (s *Server) deregister() (deregistered bool, err error) {
 	if s.cancel != nil {
 		s.cancel()
+		// 等待续约的 goroutine 退出,避免它在删除节点之后又注册回去
+		<-s.done
 	}
+	s.setRegistered(false)
 	if s.etcdManager != nil {
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-		err := s.etcdManager.DeleteEndpoint(ctx, s.etcdKey)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err = s.etcdManager.DeleteEndpoint(ctx, s.etcdKey)
+		cancel()
 		if err != nil {
-			return err
+			s.L.Error("删除 etcd 节点失败", logger.String("key", s.etcdKey), logger.Error(err))
 		}
+		deregistered = err == nil
 	}
-	err := s.EtcdClient.Close()
-	if err != nil {
-		return err
+	if s.EtcdClient != nil {
+		if er := s.EtcdClient.Close(); er != nil && err == nil {
+			err = er
+		}
 	}
-	s.Server.GracefulStop()
-	return nil
+	return deregistered, err
 }
@@ -0,0 +1,208 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package grpcx
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/naming/endpoints"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	balancerx "github.com/bgq98/utils/grpcx/balancer"
+)
+
+// fakeManager 记录注册和删除的节点,不需要启动 etcd
+type fakeManager struct {
+	endpoints.Manager
+	added   []endpoints.Endpoint
+	deleted []string
+}
+
+func (m *fakeManager) AddEndpoint(ctx context.Context, key string,
+	endpoint endpoints.Endpoint, opts ...clientv3.OpOption) error {
+	m.added = append(m.added, endpoint)
+	return nil
+}
+
+func (m *fakeManager) DeleteEndpoint(ctx context.Context, key string, opts ...clientv3.OpOption) error {
+	m.deleted = append(m.deleted, key)
+	return nil
+}
+
+func TestServer_endpointMetadata(t *testing.T) {
+	testCases := []struct {
+		name   string
+		server func() *Server
+		want   map[string]any
+	}{
+		{
+			name: "default weight",
+			server: func() *Server {
+				return &Server{}
+			},
+			want: map[string]any{"weight": balancerx.DefaultWeight},
+		},
+		{
+			name: "all fields",
+			server: func() *Server {
+				return &Server{
+					Weight:   20,
+					Labels:   []string{"canary"},
+					Version:  "v2",
+					Zone:     "sh",
+					Metadata: map[string]any{"weight": 1, "tenant": "a"},
+				}
+			},
+			want: map[string]any{
+				"weight":  20,
+				"labels":  []string{"canary"},
+				"version": "v2",
+				"zone":    "sh",
+				"tenant":  "a",
+			},
+		},
+		{
+			name: "drained",
+			server: func() *Server {
+				s := &Server{Weight: 20}
+				require.NoError(t, s.SetWeight(0))
+				return s
+			},
+			want: map[string]any{"weight": 0},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.server().endpointMetadata())
+		})
+	}
+}
+
+func TestServer_SetWeight(t *testing.T) {
+	em := &fakeManager{}
+	s := &Server{
+		Name:        "user",
+		etcdManager: em,
+		etcdKey:     "service/user/10.0.0.1:8080",
+		addr:        "10.0.0.1:8080",
+	}
+	// 租约丢失的时候只记下来,重新注册的时候带上
+	require.NoError(t, s.SetWeight(5))
+	assert.Empty(t, em.added)
+
+	s.setRegistered(true)
+	require.NoError(t, s.SetWeight(0))
+	require.Len(t, em.added, 1)
+	assert.Equal(t, "10.0.0.1:8080", em.added[0].Addr)
+	assert.Equal(t, 0, em.added[0].Metadata.(map[string]any)["weight"])
+	// 客户端看到的是 0,而不是默认权重
+	assert.Equal(t, 0, balancerx.ParseMetadata(em.added[0].Metadata).Weight)
+}
+
+func TestServer_Close(t *testing.T) {
+	testCases := []struct {
+		name    string
+		manager *fakeManager
+		// wantWait 要不要等 DrainDelay
+		wantWait bool
+	}{
+		{
+			name: "没有注册",
+		},
+		{
+			name:     "删除节点之后等待",
+			manager:  &fakeManager{},
+			wantWait: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{
+				Server:     grpc.NewServer(),
+				Name:       "user",
+				etcdKey:    "service/user/10.0.0.1:8080",
+				DrainDelay: time.Millisecond * 200,
+			}
+			if tc.manager != nil {
+				s.etcdManager = tc.manager
+			}
+			s.SetServingStatus(s.Name, healthpb.HealthCheckResponse_SERVING)
+
+			start := time.Now()
+			require.NoError(t, s.Close())
+			assert.Equal(t, tc.wantWait, time.Since(start) >= s.DrainDelay)
+			if tc.manager != nil {
+				assert.Equal(t, []string{s.etcdKey}, tc.manager.deleted)
+			}
+			// 关闭之后所有服务都是 NOT_SERVING
+			for _, service := range []string{"", s.Name} {
+				resp, err := s.health.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+				require.NoError(t, err)
+				assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.GetStatus())
+			}
+		})
+	}
+}
+
+// TestServer_Close_StopTimeout 还有没结束的流,优雅退出超时之后强制关闭
+func TestServer_Close_StopTimeout(t *testing.T) {
+	s := &Server{
+		Server:      grpc.NewServer(),
+		Name:        "user",
+		StopTimeout: time.Millisecond * 200,
+	}
+	s.SetServingStatus(s.Name, healthpb.HealthCheckResponse_SERVING)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		_ = s.Server.Serve(l)
+	}()
+
+	cc, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer cc.Close()
+	// Watch 会一直等着状态变化,不主动取消就不会结束
+	stream, err := healthpb.NewHealthClient(cc).Watch(context.Background(),
+		&healthpb.HealthCheckRequest{Service: s.Name})
+	require.NoError(t, err)
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.GetStatus())
+
+	start := time.Now()
+	require.NoError(t, s.Close())
+	assert.GreaterOrEqual(t, time.Since(start), s.StopTimeout)
+	// 先收到 NOT_SERVING,然后被强制断开
+	for {
+		resp, err = stream.Recv()
+		if err != nil {
+			break
+		}
+		assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.GetStatus())
+	}
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
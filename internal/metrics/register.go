@@ -0,0 +1,44 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package metrics 注册 prometheus 指标的辅助方法,只给这个仓库里面的其它包用
+package metrics
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Register 同一个指标注册过了就用已经注册的,
+// 这样 Build 多次或者创建多个 Builder 都不会 panic
+// r 为 nil 就注册到 prometheus.DefaultRegisterer
+func Register[T prometheus.Collector](r prometheus.Registerer, c T) T {
+	if r == nil {
+		r = prometheus.DefaultRegisterer
+	}
+	err := r.Register(c)
+	if err == nil {
+		return c
+	}
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		if existing, ok := are.ExistingCollector.(T); ok {
+			return existing
+		}
+	}
+	panic(err)
+}
@@ -0,0 +1,44 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegister(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	newCounter := func() *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "test_requests_total",
+		}, []string{"method"})
+	}
+	c1 := Register(reg, newCounter())
+	// 第二次注册拿到的是第一次注册的
+	c2 := Register(reg, newCounter())
+	assert.Same(t, c1, c2)
+
+	// 同名但是标签不一样,说明用错了
+	assert.Panics(t, func() {
+		Register(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "test_requests_total",
+		}, []string{"path"}))
+	})
+}
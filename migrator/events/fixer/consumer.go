@@ -29,6 +29,7 @@ import (
 	"github.com/bgq98/utils/migrator/events"
 	"github.com/bgq98/utils/migrator/fixer"
 	"github.com/bgq98/utils/saramax"
+	"github.com/bgq98/utils/slice"
 )
 
 type Consumer[T migrator.Entity] struct {
@@ -78,12 +79,21 @@ func (c *Consumer[T]) Start() error {
 func (c *Consumer[T]) Consume(msg *sarama.ConsumerMessage, evt events.InconsistentEvent) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
+	var f *fixer.OverrideFixer[T]
 	switch evt.Direction {
 	case "Src":
-		return c.srcFirst.Fix(ctx, evt.Id)
+		f = c.srcFirst
 	case "Dst":
-		return c.dstFirst.Fix(ctx, evt.Id)
+		f = c.dstFirst
 	default:
 		return errors.New("未知的校验方向")
 	}
+	if evt.Type == events.InconsistentEventTypeNotEqual && len(evt.Columns) > 0 {
+		// 只修复不相等的列
+		columns := slice.Map[events.ColumnDiff, string](evt.Columns, func(idx int, src events.ColumnDiff) string {
+			return src.Column
+		})
+		return f.FixColumns(ctx, evt.Id, columns)
+	}
+	return f.Fix(ctx, evt.Id)
 }
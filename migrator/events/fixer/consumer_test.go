@@ -0,0 +1,127 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fixer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+
+	"github.com/bgq98/utils/logger"
+	"github.com/bgq98/utils/migrator"
+	"github.com/bgq98/utils/migrator/events"
+)
+
+// 集成测试,需要启动数据库
+func TestConsumer_Consume(t *testing.T) {
+	src, err := gorm.Open(mysql.Open("root:root@tcp(localhost:13316)/webook"))
+	if err != nil {
+		t.Skipf("没有启动数据库: %v", err)
+	}
+	dst, err := gorm.Open(mysql.Open("root:root@tcp(localhost:13316)/webook_intr"))
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name string
+		evt  events.InconsistentEvent
+		// fixSrc 以目标表为准的时候修复的是源表
+		fixSrc  bool
+		want    FixUser
+		wantErr bool
+	}{
+		{
+			name: "不相等,只修复不相等的列",
+			evt: events.InconsistentEvent{
+				Id:        1,
+				Direction: "Src",
+				Type:      events.InconsistentEventTypeNotEqual,
+				Columns:   []events.ColumnDiff{{Column: "name"}},
+			},
+			want: FixUser{Id: 1, Name: "Tom", Email: "jerry@old.com"},
+		},
+		{
+			name: "不相等,没有列信息,覆盖整行",
+			evt: events.InconsistentEvent{
+				Id:        1,
+				Direction: "Src",
+				Type:      events.InconsistentEventTypeNotEqual,
+			},
+			want: FixUser{Id: 1, Name: "Tom", Email: "tom@new.com"},
+		},
+		{
+			name: "以目标表为准",
+			evt: events.InconsistentEvent{
+				Id:        1,
+				Direction: "Dst",
+				Type:      events.InconsistentEventTypeNotEqual,
+				Columns:   []events.ColumnDiff{{Column: "name"}},
+			},
+			fixSrc: true,
+			want:   FixUser{Id: 1, Name: "Jerry", Email: "tom@new.com"},
+		},
+		{
+			name: "未知的方向",
+			evt: events.InconsistentEvent{
+				Id:        1,
+				Direction: "unknown",
+				Type:      events.InconsistentEventTypeNotEqual,
+			},
+			want:    FixUser{Id: 1, Name: "Jerry", Email: "jerry@old.com"},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, db := range []*gorm.DB{src, dst} {
+				require.NoError(t, db.Migrator().DropTable(&FixUser{}))
+				require.NoError(t, db.AutoMigrate(&FixUser{}))
+			}
+			require.NoError(t, src.Create(&FixUser{Id: 1, Name: "Tom", Email: "tom@new.com"}).Error)
+			require.NoError(t, dst.Create(&FixUser{Id: 1, Name: "Jerry", Email: "jerry@old.com"}).Error)
+			c, err := NewConsumer[FixUser](nil, logger.NewNoOpLogger(), src, dst, "inconsistent")
+			require.NoError(t, err)
+
+			err = c.Consume(nil, tc.evt)
+			assert.Equal(t, tc.wantErr, err != nil)
+			fixed := dst
+			if tc.fixSrc {
+				fixed = src
+			}
+			var got FixUser
+			require.NoError(t, fixed.Where("id = ?", 1).First(&got).Error)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+type FixUser struct {
+	Id    int64  `gorm:"primaryKey,autoIncrement"`
+	Name  string `gorm:"type:varchar(128)"`
+	Email string `gorm:"type:varchar(128)"`
+}
+
+func (u FixUser) ID() int64 {
+	return u.Id
+}
+
+func (u FixUser) CompareTo(dst migrator.Entity) bool {
+	val, ok := dst.(FixUser)
+	return ok && u == val
+}
@@ -20,6 +20,17 @@ type InconsistentEvent struct {
 	Id        int64
 	Direction string // 以哪个源为准 SRC 源表为准 DST 目标表为准
 	Type      string
+	// Columns 不相等的列,只有 Type 是 neq 的时候才有
+	Columns []ColumnDiff `json:",omitempty"`
+}
+
+// ColumnDiff 某一列在两边的值,开启了 Validator.Values 才会带上值
+type ColumnDiff struct {
+	Column string
+	Base   any `json:",omitempty"`
+	Target any `json:",omitempty"`
+	// Redacted 敏感列,不会带上值
+	Redacted bool `json:",omitempty"`
 }
 
 const (
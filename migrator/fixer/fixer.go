@@ -49,12 +49,34 @@ func NewOverrideFixer[T migrator.Entity](base *gorm.DB, target *gorm.DB) (*Overr
 }
 
 func (o *OverrideFixer[T]) Fix(ctx context.Context, id int64) error {
+	return o.fix(ctx, id, o.columns)
+}
+
+// FixColumns 只覆盖不相等的列,目标表里面没有这条数据的时候还是插入整行
+// 列名来自消息,不在表里面的列会被忽略,全部被忽略的时候覆盖整行
+func (o *OverrideFixer[T]) FixColumns(ctx context.Context, id int64, columns []string) error {
+	cols := make([]string, 0, len(columns))
+	for _, col := range columns {
+		for _, known := range o.columns {
+			if col == known {
+				cols = append(cols, col)
+				break
+			}
+		}
+	}
+	if len(cols) == 0 {
+		cols = o.columns
+	}
+	return o.fix(ctx, id, cols)
+}
+
+func (o *OverrideFixer[T]) fix(ctx context.Context, id int64, columns []string) error {
 	var src T
 	err := o.base.WithContext(ctx).Where("id = ?", id).First(&src).Error
 	switch err {
 	case nil:
 		return o.target.Clauses(&clause.OnConflict{
-			DoUpdates: clause.AssignmentColumns(o.columns),
+			DoUpdates: clause.AssignmentColumns(columns),
 		}).Create(&src).Error
 	case gorm.ErrRecordNotFound:
 		return o.target.Delete("id = ?", id).Error
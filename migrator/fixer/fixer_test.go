@@ -0,0 +1,113 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fixer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+
+	"github.com/bgq98/utils/migrator"
+)
+
+// 集成测试,需要启动数据库
+func TestOverrideFixer_FixColumns(t *testing.T) {
+	base, target := openDB(t)
+	testCases := []struct {
+		name    string
+		target  *FixUser
+		columns []string
+		want    FixUser
+	}{
+		{
+			name:    "只覆盖指定的列",
+			target:  &FixUser{Id: 1, Name: "Jerry", Email: "jerry@old.com", Utime: 100},
+			columns: []string{"name"},
+			want:    FixUser{Id: 1, Name: "Tom", Email: "jerry@old.com", Utime: 100},
+		},
+		{
+			name:    "没有指定列,覆盖整行",
+			target:  &FixUser{Id: 1, Name: "Jerry", Email: "jerry@old.com", Utime: 100},
+			columns: []string{},
+			want:    FixUser{Id: 1, Name: "Tom", Email: "tom@new.com", Utime: 200},
+		},
+		{
+			name:    "不认识的列被忽略,覆盖整行",
+			target:  &FixUser{Id: 1, Name: "Jerry", Email: "jerry@old.com", Utime: 100},
+			columns: []string{"password"},
+			want:    FixUser{Id: 1, Name: "Tom", Email: "tom@new.com", Utime: 200},
+		},
+		{
+			name:    "目标表没有数据,插入整行",
+			columns: []string{"name"},
+			want:    FixUser{Id: 1, Name: "Tom", Email: "tom@new.com", Utime: 200},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resetTable(t, base, target)
+			require.NoError(t, base.Create(&FixUser{Id: 1, Name: "Tom", Email: "tom@new.com", Utime: 200}).Error)
+			if tc.target != nil {
+				require.NoError(t, target.Create(tc.target).Error)
+			}
+			f, err := NewOverrideFixer[FixUser](base, target)
+			require.NoError(t, err)
+			require.NoError(t, f.FixColumns(context.Background(), 1, tc.columns))
+
+			var got FixUser
+			require.NoError(t, target.Where("id = ?", 1).First(&got).Error)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func openDB(t *testing.T) (*gorm.DB, *gorm.DB) {
+	base, err := gorm.Open(mysql.Open("root:root@tcp(localhost:13316)/webook"))
+	if err != nil {
+		t.Skipf("没有启动数据库: %v", err)
+	}
+	target, err := gorm.Open(mysql.Open("root:root@tcp(localhost:13316)/webook_intr"))
+	require.NoError(t, err)
+	return base, target
+}
+
+func resetTable(t *testing.T, dbs ...*gorm.DB) {
+	for _, db := range dbs {
+		require.NoError(t, db.Migrator().DropTable(&FixUser{}))
+		require.NoError(t, db.AutoMigrate(&FixUser{}))
+	}
+}
+
+type FixUser struct {
+	Id    int64  `gorm:"primaryKey,autoIncrement"`
+	Name  string `gorm:"type:varchar(128)"`
+	Email string `gorm:"type:varchar(128)"`
+	Utime int64
+}
+
+func (u FixUser) ID() int64 {
+	return u.Id
+}
+
+func (u FixUser) CompareTo(dst migrator.Entity) bool {
+	val, ok := dst.(FixUser)
+	return ok && u == val
+}
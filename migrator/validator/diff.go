@@ -0,0 +1,56 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package validator
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/bgq98/utils/logger"
+	"github.com/bgq98/utils/migrator/events"
+)
+
+// diffColumns 通过 gorm 的 schema 逐列比较,返回不相等的列
+// CompareTo 认为不相等但是逐列比较找不到差异的时候,返回空的切片
+func (v *Validator[T]) diffColumns(base, target T) []events.ColumnDiff {
+	sch, err := v.schema()
+	if err != nil {
+		v.l.Error("解析表结构失败", logger.Error(err))
+		return nil
+	}
+	ctx := context.Background()
+	baseVal, targetVal := reflect.ValueOf(base), reflect.ValueOf(target)
+	var res []events.ColumnDiff
+	for _, field := range sch.Fields {
+		if field.DBName == "" {
+			continue
+		}
+		bv, _ := field.ValueOf(ctx, baseVal)
+		tv, _ := field.ValueOf(ctx, targetVal)
+		if reflect.DeepEqual(bv, tv) {
+			continue
+		}
+		diff := events.ColumnDiff{Column: field.DBName}
+		if _, ok := v.redact[field.DBName]; ok {
+			diff.Redacted = true
+		} else if v.values {
+			diff.Base, diff.Target = bv, tv
+		}
+		res = append(res, diff)
+	}
+	return res
+}
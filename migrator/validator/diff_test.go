@@ -0,0 +1,85 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package validator
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+
+	"github.com/bgq98/utils/logger"
+	"github.com/bgq98/utils/migrator/events"
+)
+
+func TestValidator_diffColumns(t *testing.T) {
+	db := &gorm.DB{Config: &gorm.Config{NamingStrategy: schema.NamingStrategy{}}}
+	base := BenchUser{Id: 1, Name: "Tom", Utime: 123}
+	target := BenchUser{Id: 1, Name: "Jerry", Utime: 456}
+	testCases := []struct {
+		name      string
+		validator *Validator[BenchUser]
+		want      []events.ColumnDiff
+	}{
+		{
+			name:      "columns only",
+			validator: NewValidator[BenchUser](db, db, logger.NewNoOpLogger(), nil, "SRC"),
+			want: []events.ColumnDiff{
+				{Column: "name"},
+				{Column: "utime"},
+			},
+		},
+		{
+			name: "values with redaction",
+			validator: NewValidator[BenchUser](db, db, logger.NewNoOpLogger(), nil, "SRC").
+				Values(true).Redact("name"),
+			want: []events.ColumnDiff{
+				{Column: "name", Redacted: true},
+				{Column: "utime", Base: int64(123), Target: int64(456)},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.validator.diffColumns(base, target))
+		})
+	}
+	v := NewValidator[BenchUser](db, db, logger.NewNoOpLogger(), nil, "SRC")
+	assert.Empty(t, v.diffColumns(base, base))
+}
+
+// TestNotEqual 比较全部的列,只有不相等的列才会出现在事件里面
+func (s *ValidatorTestSuite) TestNotEqual() {
+	t := s.T()
+	require.NoError(t, s.base.Create(&BenchUser{Id: 1, Name: "Tom", Utime: 100}).Error)
+	require.NoError(t, s.target.Create(&BenchUser{Id: 1, Name: "Jerry", Utime: 100}).Error)
+	producer := &recordProducer{}
+	err := NewValidator[BenchUser](s.base, s.target, logger.NewNoOpLogger(), producer, "SRC").
+		Validate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []events.InconsistentEvent{
+		{
+			Id:        1,
+			Direction: "SRC",
+			Type:      events.InconsistentEventTypeNotEqual,
+			Columns:   []events.ColumnDiff{{Column: "name"}},
+		},
+	}, producer.evts)
+}
@@ -18,10 +18,14 @@ package validator
 
 import (
 	"context"
+	"fmt"
+	"reflect"
+	"sync"
 	"time"
 
 	"golang.org/x/sync/errgroup"
 	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
 
 	"github.com/bgq98/utils/logger"
 	"github.com/bgq98/utils/migrator"
@@ -37,8 +41,16 @@ type Validator[T migrator.Entity] struct {
 	producer      events.Producer
 	direction     string
 	batchSize     int
+	timeout       time.Duration
 	utime         int64
 	sleepInterval time.Duration
+	// values 不相等的时候事件里面带上两边的值,redact 里面的列除外
+	values bool
+	redact map[string]struct{}
+
+	schemaOnce sync.Once
+	sch        *schema.Schema
+	schErr     error
 }
 
 func NewValidator[T migrator.Entity](base *gorm.DB, target *gorm.DB, l logger.Logger,
@@ -50,7 +62,9 @@ func NewValidator[T migrator.Entity](base *gorm.DB, target *gorm.DB, l logger.Lo
 		producer:      producer,
 		direction:     direction,
 		batchSize:     100,
+		timeout:       time.Second,
 		sleepInterval: 0,
+		redact:        map[string]struct{}{},
 	}
 }
 
@@ -59,6 +73,36 @@ func (v *Validator[T]) Utime(utime int64) *Validator[T] {
 	return v
 }
 
+// BatchSize 每次查询多少条数据,默认 100,小于等于 0 的时候忽略
+func (v *Validator[T]) BatchSize(size int) *Validator[T] {
+	if size > 0 {
+		v.batchSize = size
+	}
+	return v
+}
+
+// Timeout 每次查询数据库的超时时间,默认 1s,小于等于 0 的时候忽略
+func (v *Validator[T]) Timeout(timeout time.Duration) *Validator[T] {
+	if timeout > 0 {
+		v.timeout = timeout
+	}
+	return v
+}
+
+// Values 数据不相等的时候,事件里面带上两边的值,方便排查
+func (v *Validator[T]) Values(ok bool) *Validator[T] {
+	v.values = ok
+	return v
+}
+
+// Redact 敏感列,例如 password, phone,它们的值不会发到 kafka 上,用数据库里面的列名
+func (v *Validator[T]) Redact(columns ...string) *Validator[T] {
+	for _, col := range columns {
+		v.redact[col] = struct{}{}
+	}
+	return v
+}
+
 func (v *Validator[T]) SleepInterval(i time.Duration) *Validator[T] {
 	v.sleepInterval = i
 	return v
@@ -76,84 +120,125 @@ func (v *Validator[T]) Validate(ctx context.Context) error {
 	return eg.Wait()
 }
 
+// baseToTarget 按照 (utime, id) 翻页,不用 OFFSET,
+// 这样翻到后面不会越来越慢,校验过程中有数据更新也不会跳过或者重复
 func (v *Validator[T]) baseToTarget(ctx context.Context) error {
-	offset := 0
-	for {
+	utime, err := v.utimeField()
+	if err != nil {
+		return err
+	}
+	// 游标,id 是自增主键,从 0 开始就包含了 utime 相等的全部数据
+	lastUtime, lastID := v.utime, int64(0)
+	return v.scan(ctx, "base => target 查询源表失败", func(dbCtx context.Context) ([]T, error) {
 		var ts []T
-		dbCtx, cancel := context.WithTimeout(ctx, time.Second)
 		err := v.base.WithContext(dbCtx).
-			Where("utime >= ?", v.utime).
+			Where("utime > ? OR (utime = ? AND id > ?)", lastUtime, lastUtime, lastID).
 			Order("utime asc,id asc").
-			Offset(offset).Limit(v.batchSize).
+			Limit(v.batchSize).
 			Find(&ts).Error
-		cancel()
-		switch err {
-		case gorm.ErrRecordNotFound:
-			if v.sleepInterval <= 0 {
-				return nil
-			}
-			time.Sleep(v.sleepInterval)
-			continue
-		case context.DeadlineExceeded, context.Canceled:
-			return nil
-		case nil:
-			v.targetMissingRecords(ctx, ts)
-		default:
-			v.l.Error("base => target 查询源表失败", logger.Error(err))
-			time.Sleep(time.Second)
-		}
-		if len(ts) < v.batchSize {
-			// 没数据了 退出循环
-			return nil
-		}
-		offset += v.batchSize
-	}
+		return ts, err
+	}, func(ts []T) {
+		v.targetMissingRecords(ctx, ts)
+		last := ts[len(ts)-1]
+		lastUtime, lastID = utime(last), last.ID()
+	})
 }
 
+// targetToBase 先找 target 再找 base 中已经删除的,按照 id 翻页
 func (v *Validator[T]) targetToBase(ctx context.Context) error {
-	// 先找 target 再找 base 中已经删除的
-	offset := 0
-	for {
+	lastID := int64(0)
+	return v.scan(ctx, "target => base 查询目标表失败", func(dbCtx context.Context) ([]T, error) {
 		var ts []T
-		dbCtx, cancel := context.WithTimeout(ctx, time.Second)
 		err := v.target.WithContext(dbCtx).Model(new(T)).
-			Select("id").Offset(offset).
-			Limit(v.batchSize).Find(&ts).Error
+			Select("id").
+			Where("id > ?", lastID).
+			Order("id asc").
+			Limit(v.batchSize).
+			Find(&ts).Error
+		return ts, err
+	}, func(ts []T) {
+		v.baseMissingRecords(ctx, ts)
+		lastID = ts[len(ts)-1].ID()
+	})
+}
+
+// scan 不断调用 query 查询下一批数据,交给 handle 处理并且移动游标
+// 数据不够一批说明到头了,增量校验的话等一会儿再从游标的位置继续
+func (v *Validator[T]) scan(ctx context.Context, errMsg string,
+	query func(dbCtx context.Context) ([]T, error), handle func(ts []T)) error {
+	for {
+		dbCtx, cancel := context.WithTimeout(ctx, v.timeout)
+		ts, err := query(dbCtx)
 		cancel()
-		if len(ts) == 0 {
-			if v.sleepInterval <= 0 {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			v.l.Error(errMsg, logger.Error(err))
+			if !v.sleep(ctx, time.Second) {
 				return nil
 			}
-			time.Sleep(v.sleepInterval)
 			continue
 		}
-		switch err {
-		case gorm.ErrRecordNotFound:
-			if v.sleepInterval > 0 {
-				time.Sleep(v.sleepInterval)
-				continue
-			}
-		case context.DeadlineExceeded, context.Canceled:
-			return nil
-		case nil:
-			v.baseMissingRecords(ctx, ts)
-		default:
-			// 记录日志
-			v.l.Error("target => base 查询目标表失败", logger.Error(err))
+		if len(ts) > 0 {
+			handle(ts)
 		}
 		if len(ts) < v.batchSize {
-			// 没数据了 退出循环
-			return nil
+			if v.sleepInterval <= 0 || !v.sleep(ctx, v.sleepInterval) {
+				return nil
+			}
 		}
-		offset += v.batchSize
 	}
 }
 
+// sleep 返回 false 说明 ctx 结束了
+func (v *Validator[T]) sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (v *Validator[T]) schema() (*schema.Schema, error) {
+	v.schemaOnce.Do(func() {
+		v.sch, v.schErr = schema.Parse(new(T), &sync.Map{}, v.base.NamingStrategy)
+	})
+	return v.sch, v.schErr
+}
+
+// utimeField 通过 gorm 的 schema 读取 utime 字段,Entity 上面没有对应的方法
+func (v *Validator[T]) utimeField() (func(t T) int64, error) {
+	sch, err := v.schema()
+	if err != nil {
+		return nil, err
+	}
+	field := sch.LookUpField("utime")
+	if field == nil {
+		return nil, fmt.Errorf("validator: %s 没有 utime 字段", sch.Name)
+	}
+	return func(t T) int64 {
+		val, _ := field.ValueOf(context.Background(), reflect.ValueOf(t))
+		rv := reflect.ValueOf(val)
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return rv.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return int64(rv.Uint())
+		default:
+			return 0
+		}
+	}, nil
+}
+
 func (v *Validator[T]) baseMissingRecords(ctx context.Context, ts []T) {
 	ids := slice.Map[T, int64](ts, func(idx int, src T) int64 {
 		return src.ID()
 	})
-	dbCtx, cancel := context.WithTimeout(ctx, time.Second)
+	dbCtx, cancel := context.WithTimeout(ctx, v.timeout)
 	defer cancel()
 	base := v.base.WithContext(dbCtx)
 	var srcTs []T
@@ -177,52 +262,45 @@ func (v *Validator[T]) targetMissingRecords(ctx context.Context, ts []T) {
 	ids := slice.Map[T, int64](ts, func(idx int, src T) int64 {
 		return src.ID()
 	})
-	dbCtx, cancel := context.WithTimeout(ctx, time.Second)
+	dbCtx, cancel := context.WithTimeout(ctx, v.timeout)
 	defer cancel()
-	var srcTs []T
-	target := v.target.WithContext(dbCtx)
-	err := target.Select("id").Where("id in ?", ids).Find(&srcTs).Error
-	switch err {
-	case gorm.ErrRecordNotFound:
-		v.notifyTargetMissing(ts, events.InconsistentEventTypeTargetMissing)
-	case nil:
-		missing := slice.DiffSetFunc[T](ts, srcTs, func(src, dst T) bool {
-			if !src.CompareTo(dst) {
-				return src.ID() == dst.ID()
-			}
-			return false
-		})
-		v.notifyTargetNotEqual(missing, events.InconsistentEventTypeNotEqual)
-	default:
+	// 要比较全部的列,所以不能只查 id
+	var dstTs []T
+	err := v.target.WithContext(dbCtx).Where("id in ?", ids).Find(&dstTs).Error
+	if err != nil {
 		v.l.Error("base => target 查询目标表失败", logger.Error(err))
+		return
 	}
-}
-
-func (v *Validator[T]) notifyBaseMissing(ts []T, typ string) {
-	for _, t := range ts {
-		v.notify(t.ID(), typ)
+	dstMap := make(map[int64]T, len(dstTs))
+	for _, dst := range dstTs {
+		dstMap[dst.ID()] = dst
 	}
-}
-
-func (v *Validator[T]) notifyTargetMissing(ts []T, typ string) {
-	for _, t := range ts {
-		v.notify(t.ID(), typ)
+	for _, src := range ts {
+		dst, ok := dstMap[src.ID()]
+		if !ok {
+			v.notify(src.ID(), events.InconsistentEventTypeTargetMissing, nil)
+			continue
+		}
+		if !src.CompareTo(dst) {
+			v.notify(src.ID(), events.InconsistentEventTypeNotEqual, v.diffColumns(src, dst))
+		}
 	}
 }
 
-func (v *Validator[T]) notifyTargetNotEqual(ts []T, typ string) {
+func (v *Validator[T]) notifyBaseMissing(ts []T, typ string) {
 	for _, t := range ts {
-		v.notify(t.ID(), typ)
+		v.notify(t.ID(), typ, nil)
 	}
 }
 
-func (v *Validator[T]) notify(id int64, typ string) {
+func (v *Validator[T]) notify(id int64, typ string, columns []events.ColumnDiff) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 	evt := events.InconsistentEvent{
 		Id:        id,
 		Direction: v.direction,
 		Type:      typ,
+		Columns:   columns,
 	}
 
 	err := v.producer.ProduceInsistentEvent(ctx, evt)
@@ -0,0 +1,296 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package validator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+
+	"github.com/bgq98/utils/logger"
+	"github.com/bgq98/utils/migrator"
+	"github.com/bgq98/utils/migrator/events"
+)
+
+func TestValidator_utimeField(t *testing.T) {
+	db := &gorm.DB{Config: &gorm.Config{NamingStrategy: schema.NamingStrategy{}}}
+	v := NewValidator[BenchUser](db, db, logger.NewNoOpLogger(), nil, "SRC")
+	utime, err := v.utimeField()
+	require.NoError(t, err)
+	require.Equal(t, int64(123), utime(BenchUser{Id: 1, Utime: 123}))
+}
+
+func TestValidator_BatchSizeTimeout(t *testing.T) {
+	v := NewValidator[BenchUser](nil, nil, logger.NewNoOpLogger(), nil, "SRC")
+	// 0 和负数会导致一直查询,忽略
+	v.BatchSize(0).BatchSize(-1).Timeout(0).Timeout(-time.Second)
+	assert.Equal(t, 100, v.batchSize)
+	assert.Equal(t, time.Second, v.timeout)
+
+	v.BatchSize(10).Timeout(time.Second * 3)
+	assert.Equal(t, 10, v.batchSize)
+	assert.Equal(t, time.Second*3, v.timeout)
+}
+
+func TestValidator_scan(t *testing.T) {
+	v := NewValidator[BenchUser](nil, nil, logger.NewNoOpLogger(), nil, "SRC").BatchSize(3)
+	batches := [][]BenchUser{
+		{{Id: 1}, {Id: 2}, {Id: 3}},
+		{{Id: 4}, {Id: 5}, {Id: 6}},
+		{{Id: 7}},
+	}
+	var queries int
+	var handled []int64
+	err := v.scan(context.Background(), "查询失败", func(dbCtx context.Context) ([]BenchUser, error) {
+		// 每次查询都有超时时间
+		_, ok := dbCtx.Deadline()
+		assert.True(t, ok)
+		res := batches[queries]
+		queries++
+		return res, nil
+	}, func(ts []BenchUser) {
+		for _, u := range ts {
+			handled = append(handled, u.Id)
+		}
+	})
+	require.NoError(t, err)
+	// 最后一批不够 3 条,说明到头了
+	assert.Equal(t, 3, queries)
+	assert.Equal(t, []int64{1, 2, 3, 4, 5, 6, 7}, handled)
+}
+
+// ValidatorTestSuite 集成测试,需要启动数据库
+type ValidatorTestSuite struct {
+	suite.Suite
+	base   *gorm.DB
+	target *gorm.DB
+}
+
+func (s *ValidatorTestSuite) SetupSuite() {
+	s.base, s.target = openDB(s.T())
+}
+
+func (s *ValidatorTestSuite) SetupTest() {
+	resetTable(s.T(), s.base, s.target)
+}
+
+// TestPaging 很多数据的 utime 相同,并且跨越了批次的边界,不能漏掉也不能重复
+func (s *ValidatorTestSuite) TestPaging() {
+	t := s.T()
+	const rows = 25
+	us := make([]BenchUser, 0, rows)
+	for i := 1; i <= rows; i++ {
+		us = append(us, BenchUser{
+			Id:   int64(i),
+			Name: fmt.Sprintf("user_%d", i),
+			// 只有 3 种 utime,并且 id 的顺序和 utime 的顺序不一致
+			Utime: int64(100 + i%3),
+		})
+	}
+	testCases := []struct {
+		name     string
+		base     []BenchUser
+		target   []BenchUser
+		wantType string
+	}{
+		{
+			name:     "base => target",
+			base:     us,
+			wantType: events.InconsistentEventTypeTargetMissing,
+		},
+		{
+			name:     "target => base",
+			target:   us,
+			wantType: events.InconsistentEventTypeBaseMissing,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resetTable(t, s.base, s.target)
+			if len(tc.base) > 0 {
+				require.NoError(t, s.base.Create(tc.base).Error)
+			}
+			if len(tc.target) > 0 {
+				require.NoError(t, s.target.Create(tc.target).Error)
+			}
+			producer := &recordProducer{}
+			err := NewValidator[BenchUser](s.base, s.target, logger.NewNoOpLogger(), producer, "SRC").
+				BatchSize(4).
+				Validate(context.Background())
+			require.NoError(t, err)
+
+			ids := make([]int64, 0, len(producer.evts))
+			for _, evt := range producer.evts {
+				assert.Equal(t, tc.wantType, evt.Type)
+				ids = append(ids, evt.Id)
+			}
+			sort.Slice(ids, func(i, j int) bool {
+				return ids[i] < ids[j]
+			})
+			want := make([]int64, 0, rows)
+			for i := 1; i <= rows; i++ {
+				want = append(want, int64(i))
+			}
+			assert.Equal(t, want, ids)
+		})
+	}
+}
+
+func TestValidator(t *testing.T) {
+	suite.Run(t, new(ValidatorTestSuite))
+}
+
+const benchRows = 200000
+
+// 集成测试,需要启动数据库
+// 两种翻页方式做的事情一样:翻页扫描,到另一边查询,发送不一致的事件
+// 表越大 OFFSET 越慢
+func BenchmarkValidator_Validate(b *testing.B) {
+	base, target := initBenchDB(b)
+	ctx := context.Background()
+	for _, size := range []int{100, 1000} {
+		b.Run(fmt.Sprintf("keyset_%d", size), func(b *testing.B) {
+			producer := &countProducer{}
+			v := NewValidator[BenchUser](base, target, logger.NewNoOpLogger(), producer, "SRC").
+				BatchSize(size)
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, v.baseToTarget(ctx))
+				require.NoError(b, v.targetToBase(ctx))
+			}
+			b.ReportMetric(float64(producer.cnt.Load())/float64(b.N), "events/op")
+		})
+		b.Run(fmt.Sprintf("offset_%d", size), func(b *testing.B) {
+			producer := &countProducer{}
+			v := NewValidator[BenchUser](base, target, logger.NewNoOpLogger(), producer, "SRC").
+				BatchSize(size)
+			for i := 0; i < b.N; i++ {
+				offsetScan(b, v, base.Order("utime asc,id asc"), func(ts []BenchUser) {
+					v.targetMissingRecords(ctx, ts)
+				})
+				offsetScan(b, v, target.Select("id").Order("id asc"), func(ts []BenchUser) {
+					v.baseMissingRecords(ctx, ts)
+				})
+			}
+			b.ReportMetric(float64(producer.cnt.Load())/float64(b.N), "events/op")
+		})
+	}
+}
+
+// offsetScan 原本用 OFFSET 翻页的做法,用来对比
+func offsetScan(b *testing.B, v *Validator[BenchUser], query *gorm.DB, handle func(ts []BenchUser)) {
+	for offset := 0; ; offset += v.batchSize {
+		var ts []BenchUser
+		err := query.Offset(offset).Limit(v.batchSize).Find(&ts).Error
+		require.NoError(b, err)
+		if len(ts) > 0 {
+			handle(ts)
+		}
+		if len(ts) < v.batchSize {
+			return
+		}
+	}
+}
+
+// initBenchDB target 比 base 少 1% 的数据
+func initBenchDB(b *testing.B) (*gorm.DB, *gorm.DB) {
+	base, target := openDB(b)
+	resetTable(b, base, target)
+	us := make([]BenchUser, 0, benchRows)
+	for i := 1; i <= benchRows; i++ {
+		us = append(us, BenchUser{
+			Id:    int64(i),
+			Name:  fmt.Sprintf("user_%d", i),
+			Utime: int64(i % 1000),
+		})
+	}
+	require.NoError(b, base.CreateInBatches(us, 1000).Error)
+	targetUs := make([]BenchUser, 0, benchRows)
+	for _, u := range us {
+		if u.Id%100 != 0 {
+			targetUs = append(targetUs, u)
+		}
+	}
+	require.NoError(b, target.CreateInBatches(targetUs, 1000).Error)
+	return base, target
+}
+
+// openDB 没有启动数据库就跳过
+func openDB(t testing.TB) (*gorm.DB, *gorm.DB) {
+	base, err := gorm.Open(mysql.Open("root:root@tcp(localhost:13316)/webook"))
+	if err != nil {
+		t.Skipf("没有启动数据库: %v", err)
+	}
+	target, err := gorm.Open(mysql.Open("root:root@tcp(localhost:13316)/webook_intr"))
+	require.NoError(t, err)
+	return base, target
+}
+
+func resetTable(t require.TestingT, dbs ...*gorm.DB) {
+	for _, db := range dbs {
+		require.NoError(t, db.Migrator().DropTable(&BenchUser{}))
+		require.NoError(t, db.AutoMigrate(&BenchUser{}))
+	}
+}
+
+// BenchUser secondary index 里面带了主键,所以 utime 上面的索引就能支持按照 (utime, id) 翻页
+type BenchUser struct {
+	Id    int64  `gorm:"primaryKey,autoIncrement"`
+	Name  string `gorm:"type:varchar(128)"`
+	Utime int64  `gorm:"index"`
+}
+
+func (u BenchUser) ID() int64 {
+	return u.Id
+}
+
+func (u BenchUser) CompareTo(dst migrator.Entity) bool {
+	val, ok := dst.(BenchUser)
+	return ok && u == val
+}
+
+type countProducer struct {
+	cnt atomic.Int64
+}
+
+func (p *countProducer) ProduceInsistentEvent(ctx context.Context, evt events.InconsistentEvent) error {
+	p.cnt.Add(1)
+	return nil
+}
+
+// recordProducer 两个方向是并发校验的,要加锁
+type recordProducer struct {
+	lock sync.Mutex
+	evts []events.InconsistentEvent
+}
+
+func (p *recordProducer) ProduceInsistentEvent(ctx context.Context, evt events.InconsistentEvent) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.evts = append(p.evts, evt)
+	return nil
+}
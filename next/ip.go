@@ -16,8 +16,22 @@
 
 package next
 
-import "net"
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+)
 
+// EnvIP 默认从这个环境变量读取本机 ip,例如 k8s 里面用 downward API 注入的 POD_IP
+const EnvIP = "POD_IP"
+
+// ErrNoIP 找不到符合条件的 ip
+var ErrNoIP = errors.New("next: 找不到可用的 ip")
+
+// GetOutboundIp 通过连接外网的 dns 获得本机 ip
+// Deprecated: 离线环境下会返回空字符串,使用 IPResolver
 func GetOutboundIp() string {
 	// dns 的地址,国内可以用 114.114.114.114
 	conn, err := net.Dial("udp", "8.8.8.8:80")
@@ -29,3 +43,162 @@ func GetOutboundIp() string {
 	localAddr := conn.LocalAddr().(*net.UDPAddr)
 	return localAddr.IP.String()
 }
+
+// IPResolver 获取本机用来对外提供服务的 ip,零值可以直接使用
+// 优先级依次是 IP, 环境变量, 遍历网卡
+// 遍历网卡的时候会跳过没有启动的网卡, 回环地址和链路本地地址
+type IPResolver struct {
+	// IP 显式指定
+	IP string
+	// Env 从这个环境变量读取,不设置默认 POD_IP
+	Env string
+	// Interfaces 网卡的优先级,例如 eth0, en0,不在里面的网卡排在最后
+	Interfaces []string
+	// Allow 只用这些网段的 ip,例如 10.0.0.0/8
+	Allow []string
+	// Deny 排除这些网段的 ip,例如 docker 的 172.17.0.0/16
+	Deny []string
+	// PreferIPv6 默认优先 IPv4
+	PreferIPv6 bool
+
+	// interfaces 测试的时候替换
+	interfaces func() ([]netInterface, error)
+}
+
+type netInterface struct {
+	name  string
+	addrs []net.IP
+}
+
+// Resolve 找不到的时候返回 ErrNoIP
+func (r *IPResolver) Resolve() (string, error) {
+	if r.IP != "" {
+		return validIP(r.IP)
+	}
+	env := r.Env
+	if env == "" {
+		env = EnvIP
+	}
+	if val := os.Getenv(env); val != "" {
+		return validIP(val)
+	}
+	allow, err := parseCIDRs(r.Allow)
+	if err != nil {
+		return "", err
+	}
+	deny, err := parseCIDRs(r.Deny)
+	if err != nil {
+		return "", err
+	}
+	listInterfaces := r.interfaces
+	if listInterfaces == nil {
+		listInterfaces = systemInterfaces
+	}
+	ifaces, err := listInterfaces()
+	if err != nil {
+		return "", err
+	}
+
+	type candidate struct {
+		ip    net.IP
+		rank  int
+		order int
+	}
+	var candidates []candidate
+	for _, iface := range ifaces {
+		rank := r.rank(iface.name)
+		for _, ip := range iface.addrs {
+			if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+				continue
+			}
+			if contains(deny, ip) || (len(allow) > 0 && !contains(allow, ip)) {
+				continue
+			}
+			candidates = append(candidates, candidate{ip: ip, rank: rank, order: len(candidates)})
+		}
+	}
+	if len(candidates) == 0 {
+		return "", ErrNoIP
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		ci, cj := candidates[i], candidates[j]
+		if ci.rank != cj.rank {
+			return ci.rank < cj.rank
+		}
+		// 协议族一样的时候保持网卡上原本的顺序
+		return r.preferred(ci.ip) && !r.preferred(cj.ip)
+	})
+	return candidates[0].ip.String(), nil
+}
+
+// rank 在 Interfaces 里面的位置,越小越优先
+func (r *IPResolver) rank(name string) int {
+	for i, val := range r.Interfaces {
+		if val == name {
+			return i
+		}
+	}
+	return len(r.Interfaces)
+}
+
+func (r *IPResolver) preferred(ip net.IP) bool {
+	isV4 := ip.To4() != nil
+	return isV4 != r.PreferIPv6
+}
+
+func systemInterfaces() ([]netInterface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]netInterface, 0, len(ifaces))
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		ni := netInterface{name: iface.Name}
+		for _, addr := range addrs {
+			switch v := addr.(type) {
+			case *net.IPNet:
+				ni.addrs = append(ni.addrs, v.IP)
+			case *net.IPAddr:
+				ni.addrs = append(ni.addrs, v.IP)
+			}
+		}
+		res = append(res, ni)
+	}
+	return res, nil
+}
+
+func validIP(val string) (string, error) {
+	ip := net.ParseIP(val)
+	if ip == nil {
+		return "", fmt.Errorf("next: 不合法的 ip %q", val)
+	}
+	return ip.String(), nil
+}
+
+func parseCIDRs(vals []string) ([]*net.IPNet, error) {
+	res := make([]*net.IPNet, 0, len(vals))
+	for _, val := range vals {
+		_, ipNet, err := net.ParseCIDR(val)
+		if err != nil {
+			return nil, fmt.Errorf("next: 不合法的网段 %q: %w", val, err)
+		}
+		res = append(res, ipNet)
+	}
+	return res, nil
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
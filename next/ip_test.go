@@ -0,0 +1,134 @@
+/*
+   Copyright 2023 bgq98
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package next
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPResolver_Resolve(t *testing.T) {
+	ifaces := []netInterface{
+		{
+			name: "docker0",
+			addrs: []net.IP{
+				net.ParseIP("172.17.0.1"),
+			},
+		},
+		{
+			name: "eth0",
+			addrs: []net.IP{
+				net.ParseIP("fe80::1"),
+				net.ParseIP("2001:db8::10"),
+				net.ParseIP("10.0.0.10"),
+			},
+		},
+		{
+			name: "eth1",
+			addrs: []net.IP{
+				net.ParseIP("192.168.1.10"),
+			},
+		},
+	}
+	testCases := []struct {
+		name     string
+		resolver *IPResolver
+		env      string
+		ifaces   []netInterface
+		wantIP   string
+		wantErr  bool
+	}{
+		{
+			name:     "explicit",
+			resolver: &IPResolver{IP: "10.1.1.1"},
+			env:      "10.2.2.2",
+			wantIP:   "10.1.1.1",
+		},
+		{
+			name:     "invalid explicit",
+			resolver: &IPResolver{IP: "abc"},
+			wantErr:  true,
+		},
+		{
+			name:     "env",
+			resolver: &IPResolver{},
+			env:      "10.2.2.2",
+			wantIP:   "10.2.2.2",
+		},
+		{
+			name:     "first interface",
+			resolver: &IPResolver{},
+			ifaces:   ifaces,
+			wantIP:   "172.17.0.1",
+		},
+		{
+			name:     "deny",
+			resolver: &IPResolver{Deny: []string{"172.17.0.0/16"}},
+			ifaces:   ifaces,
+			wantIP:   "10.0.0.10",
+		},
+		{
+			name:     "allow",
+			resolver: &IPResolver{Allow: []string{"192.168.0.0/16"}},
+			ifaces:   ifaces,
+			wantIP:   "192.168.1.10",
+		},
+		{
+			name:     "interface preference",
+			resolver: &IPResolver{Interfaces: []string{"eth1", "eth0"}},
+			ifaces:   ifaces,
+			wantIP:   "192.168.1.10",
+		},
+		{
+			name:     "prefer ipv6",
+			resolver: &IPResolver{Interfaces: []string{"eth0"}, PreferIPv6: true},
+			ifaces:   ifaces,
+			wantIP:   "2001:db8::10",
+		},
+		{
+			name:     "invalid cidr",
+			resolver: &IPResolver{Allow: []string{"10.0.0.0"}},
+			ifaces:   ifaces,
+			wantErr:  true,
+		},
+		{
+			name:     "no ip",
+			resolver: &IPResolver{},
+			ifaces: []netInterface{
+				{name: "eth0", addrs: []net.IP{net.ParseIP("fe80::1")}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(EnvIP, tc.env)
+			tc.resolver.interfaces = func() ([]netInterface, error) {
+				return tc.ifaces, nil
+			}
+			ip, err := tc.resolver.Resolve()
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantIP, ip)
+		})
+	}
+}